@@ -0,0 +1,48 @@
+package upload
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Graph 路径中 + 可能被当作空格，: 是 root:/path: 的分隔符，这两个字符也需要转义
+var segmentEscaper = strings.NewReplacer("+", "%2B", ":", "%3A")
+
+// escapeItemPath escapes every segment of the slash separated remotePath, so
+// names with #, %, ? or + reach Graph unchanged
+func escapeItemPath(remotePath string) string {
+	segments := strings.Split(strings.Trim(remotePath, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = segmentEscaper.Replace(url.PathEscape(segment))
+	}
+	return strings.Join(segments, "/")
+}
+
+// graphItemIDPath returns the Graph path of the item itemID in the drive of
+// userId followed by action, for an item that has to be addressed by its ID
+// because its name is not the one of the local file
+func graphItemIDPath(userId string, itemID string, action string) string {
+	idPath := fmt.Sprintf(itemPath, url.PathEscape(userId), url.PathEscape(itemID))
+	if action != "" {
+		idPath += "/" + action
+	}
+	return idPath
+}
+
+// graphItemPath returns the Graph path of the item at remotePath in the drive
+// of userId, followed by action such as "content" or "children" when it is not
+// empty. Every Graph request addressing an item by its path is built here.
+func graphItemPath(userId string, remotePath string, action string) string {
+	itemPath := fmt.Sprintf("/users/%s/drive/root", url.PathEscape(userId))
+	if p := strings.Trim(remotePath, "/"); p != "" && p != "." {
+		itemPath += ":/" + escapeItemPath(p)
+		if action != "" {
+			itemPath += ":"
+		}
+	}
+	if action != "" {
+		itemPath += "/" + action
+	}
+	return itemPath
+}
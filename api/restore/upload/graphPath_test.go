@@ -0,0 +1,171 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"main/fileutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// trickyNames 是在 URL 中有特殊含义或需要转义的文件名
+var trickyNames = []string{
+	"a#b.txt",
+	"100%.txt",
+	"100%25.txt",
+	"what?.txt",
+	"a+b.txt",
+	"space name.txt",
+	"中文 文件.txt",
+	"a&b=c.txt",
+	"semi;colon.txt",
+	"ti~lde's (1).txt",
+	"dir#1/sub?dir/file+1.txt",
+}
+
+// fakeGraph records the method and decoded path of every request it receives
+type fakeGraph struct {
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (f *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.mutex.Unlock()
+	_, _ = ioutil.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "1", "name": "x", "value": []interface{}{}})
+	case "POST":
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "1", "uploadUrl": "http://example.invalid/upload"})
+	default:
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "item!1"})
+	}
+}
+
+// last returns the last request and forgets all of them
+func (f *fakeGraph) last(t *testing.T) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.requests) == 0 {
+		t.Fatal("no request reached the server")
+	}
+	request := f.requests[len(f.requests)-1]
+	f.requests = nil
+	return request
+}
+
+func newFakeGraph(t *testing.T) (*fakeGraph, *RestoreService) {
+	fake := &fakeGraph{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	rs := GetRestoreService(srv.Client())
+	rs.BaseURL = srv.URL
+	return fake, rs
+}
+
+func TestGraphItemPath(t *testing.T) {
+	tests := []struct {
+		remotePath string
+		action     string
+		want       string
+	}{
+		{"", "children", "/users/u/drive/root/children"},
+		{"/", "children", "/users/u/drive/root/children"},
+		{"", "", "/users/u/drive/root"},
+		{"a/b.txt", "", "/users/u/drive/root:/a/b.txt"},
+		{"/a/b.txt/", "content", "/users/u/drive/root:/a/b.txt:/content"},
+		{"a#b/c?d.txt", "content", "/users/u/drive/root:/a%23b/c%3Fd.txt:/content"},
+		{"100%.txt", "createUploadSession", "/users/u/drive/root:/100%25.txt:/createUploadSession"},
+		{"a+b c.txt", "children", "/users/u/drive/root:/a%2Bb%20c.txt:/children"},
+		{"a:b.txt", "", "/users/u/drive/root:/a%3Ab.txt"},
+	}
+	for _, test := range tests {
+		if got := graphItemPath("u", test.remotePath, test.action); got != test.want {
+			t.Errorf("graphItemPath(%q, %q) = %q, want %q", test.remotePath, test.action, got, test.want)
+		}
+	}
+}
+
+func TestGraphRequestsEscapeNames(t *testing.T) {
+	fake, rs := newFakeGraph(t)
+	ctx := context.Background()
+	for _, name := range trickyNames {
+		want := "/users/user@example.com/drive/root:/target/" + name
+		if _, _, err := rs.GetItem(ctx, "user@example.com", "token", "target/"+name); err != nil {
+			t.Errorf("GetItem %q: %v", name, err)
+		}
+		if got := fake.last(t); got != "GET "+want {
+			t.Errorf("GetItem %q requested %q", name, got)
+		}
+		if _, err := rs.GetDriveItem(ctx, "user@example.com", "token", "target/"+name); err != nil {
+			t.Errorf("GetDriveItem %q: %v", name, err)
+		}
+		if got := fake.last(t); got != "GET "+want+":/children" {
+			t.Errorf("GetDriveItem %q requested %q", name, got)
+		}
+		if err := rs.CreateFolder(ctx, "user@example.com", "token", "target/"+name); err != nil {
+			t.Errorf("CreateFolder %q: %v", name, err)
+		}
+		if got, parent := fake.last(t), filepath.ToSlash(filepath.Dir(want)); got != "POST "+parent+":/children" {
+			t.Errorf("CreateFolder %q requested %q", name, got)
+		}
+	}
+}
+
+func TestUploadRequestsEscapeNames(t *testing.T) {
+	fake, rs := newFakeGraph(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// getUploadSession 用本地相对路径计算网盘路径
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	locText := func(text string) string { return text }
+	for _, name := range trickyNames {
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want := "/users/u/drive/root:/target/" + name
+
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := fileutil.FileInfo{FileData: f, SizeType: fileutil.SizeTypeSmall}
+		if _, err = rs.SimpleUploadToOriginalLoc(ctx, "u", "token", "replace", "", "", "target", name, info, locText); err != nil {
+			t.Errorf("SimpleUploadToOriginalLoc %q: %v", name, err)
+		}
+		_ = f.Close()
+		fake.mutex.Lock()
+		requests := fake.requests
+		fake.mutex.Unlock()
+		if len(requests) != 2 || requests[0] != "PUT "+want+":/content" || requests[1] != "PATCH /users/u/drive/items/item!1" {
+			t.Errorf("SimpleUploadToOriginalLoc %q requested %q", name, requests)
+		}
+		fake.last(t)
+
+		if _, err = rs.getUploadSession(ctx, "u", "token", "replace", "", "", "target", name); err != nil {
+			t.Errorf("getUploadSession %q: %v", name, err)
+		}
+		if got := fake.last(t); got != "POST "+want+":/createUploadSession" {
+			t.Errorf("getUploadSession %q requested %q", name, got)
+		}
+	}
+}
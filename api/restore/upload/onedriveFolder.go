@@ -0,0 +1,108 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	httpLocal "main/graph/net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CreateFolder creates the folder folderPath, its parent has to exist already.
+// A folder that already exists is not an error.
+func (rs *RestoreService) CreateFolder(ctx context.Context, userId string, bearerToken string, folderPath string) error {
+	parent, name := path.Split(strings.Trim(folderPath, "/"))
+	uploadPath := graphItemPath(userId, parent, "children")
+	body, err := json.Marshal(map[string]interface{}{
+		"name":                              name,
+		"folder":                            map[string]interface{}{},
+		"@microsoft.graph.conflictBehavior": "fail",
+	})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := rs.NewRequest("POST", uploadPath, getRessumableUploadSessionHeader(bearerToken), body)
+		if err != nil {
+			return err
+		}
+		resp, err := rs.Do(req.WithContext(ctx))
+		httpLocal.DrainBody(resp)
+		if httpLocal.IsUnauthorized(err) {
+			bearerToken = httpLocal.RefreshBearer()
+			continue
+		}
+		if httpLocal.IsConflict(err) {
+			// 文件夹已经存在
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("create folder %s: unauthorized", folderPath)
+}
+
+// CreateFolders creates every folder in folders and their parents before any
+// file is uploaded, so empty folders exist on the drive too and the workers
+// don't race to create the same parents. Folders of the same depth are
+// created concurrently by up to threads requests.
+func (rs *RestoreService) CreateFolders(ctx context.Context, userId string, bearerToken string, folders []string, threads int) error {
+	levels := make(map[int]map[string]bool)
+	for _, folder := range folders {
+		parts := strings.Split(strings.Trim(folder, "/"), "/")
+		for i := range parts {
+			if parts[i] == "" || parts[i] == "." {
+				continue
+			}
+			if levels[i] == nil {
+				levels[i] = make(map[string]bool)
+			}
+			levels[i][strings.Join(parts[:i+1], "/")] = true
+		}
+	}
+	depths := make([]int, 0, len(levels))
+	for depth := range levels {
+		depths = append(depths, depth)
+	}
+	sort.Ints(depths)
+
+	if threads < 1 {
+		threads = 1
+	}
+	for _, depth := range depths {
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		var firstErr error
+		pool := make(chan struct{}, threads)
+		for folder := range levels[depth] {
+			if ctx.Err() != nil {
+				break
+			}
+			wg.Add(1)
+			pool <- struct{}{}
+			go func(folder string) {
+				defer wg.Done()
+				defer func() {
+					<-pool
+				}()
+				if err := rs.CreateFolder(ctx, userId, bearerToken, folder); err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("%s: %v", folder, err)
+					}
+					mutex.Unlock()
+				}
+			}(folder)
+		}
+		wg.Wait()
+		if firstErr != nil {
+			return firstErr
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -1,12 +1,17 @@
 package upload
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"main/fileutil"
-	http2 "main/graph/net/http"
+	httpLocal "main/graph/net/http"
+	"main/notify"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
 	"runtime/debug"
 	"strconv"
@@ -15,105 +20,166 @@ import (
 )
 
 const (
-	uploadSessionPath = "/users/%s/drive/root:/%s:/createUploadSession"
-	uploadURLKey      = "uploadUrl"
+	uploadURLKey = "uploadUrl"
 )
 
-func (rs *RestoreService) recoverableUpload(userID string, bearerToken string, conflictOption string, targetFolder string, filePath string, fileInfo fileutil.FileInfo, sendMsg func(text string), locText func(text string) string, username string) []map[string]interface{} {
-	//1. Get recoverable upload session for the current file path 获取当前文件路径的可压缩上载会话
-	uploadSessionData, err := rs.getUploadSession(userID, bearerToken, conflictOption, targetFolder, filePath)
+func (rs *RestoreService) recoverableUpload(ctx context.Context, userID string, bearerToken string, conflictOption string, ifMatch string, itemID string, targetFolder string, filePath string, fileInfo fileutil.FileInfo, locText func(text string) string) ([]map[string]interface{}, error) {
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil, fileutil.ErrVanished
+	}
 	if err != nil {
-		sendMsg(fmt.Sprintf(locText("filenameFail"), filePath))
-		return nil
+		return nil, err
 	}
+	_size := stat.Size()
+	resumeKey := fileutil.RemotePath(filepath.Join(targetFolder, filePath))
 
-	//2. Get the upload url returned as a response from the recoverable upload session above. 从上面的可压缩上载会话获取作为响应返回的上载url。
-	uploadURL := uploadSessionData[uploadURLKey].(string)
-
-	//3. Get the startOffset list for the file 获取文件的startOffset列表
-	startOffsetLst, err := fileutil.GetFileOffsetStash(filePath)
-	if err != nil {
-		log.Panicf(locText("failToStore"), err)
+	//1. Get recoverable upload session for the current file path, or continue the one saved by an interrupted run
+	// 获取当前文件路径的可恢复上载会话，如果上次运行被中断，则从保存的断点继续
+	var uploadURL string
+	var offset int64
+	if item, ok := rs.Resume.Get(resumeKey, _size, stat.ModTime().Unix()); ok {
+		if next, err := rs.getUploadSessionOffset(ctx, item.UploadURL); err == nil {
+			uploadURL, offset = item.UploadURL, next
+		}
 	}
-	_size, err := fileutil.GetFileSize(filePath)
-	if err != nil {
-		log.Panicf(locText("failToStore"), err)
+	if uploadURL == "" {
+		uploadSessionData, err := rs.getUploadSession(ctx, userID, bearerToken, conflictOption, ifMatch, itemID, targetFolder, filePath)
+		if httpLocal.IsUnauthorized(err) {
+			bearerToken = httpLocal.RefreshBearer()
+			uploadSessionData, err = rs.getUploadSession(ctx, userID, bearerToken, conflictOption, ifMatch, itemID, targetFolder, filePath)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, httpLocal.ErrInterrupted
+			}
+			return nil, err
+		}
+		//2. Get the upload url returned as a response from the recoverable upload session above. 从上面的可压缩上载会话获取作为响应返回的上载url。
+		var ok bool
+		if uploadURL, ok = uploadSessionData[uploadURLKey].(string); !ok || uploadURL == "" {
+			return nil, fmt.Errorf("upload session of %s has no %s", filePath, uploadURLKey)
+		}
 	}
-	//log.Panicln(fileutil.Byte2Readable(size))
-	size := byte2Readable(float64(_size))
 
-	//4. Loop over the file start offset list to read files in chunk and upload in onedrive 在文件开始偏移量列表上循环以读取块中的文件并在onedrive中上载
+	//3. Loop over the file in chunks and upload them to onedrive 按分块循环读取文件并上传到onedrive
 	var uploadResp []map[string]interface{}
-	lastChunkIndex := len(startOffsetLst) - 1
-	var isLastChunk bool
-	timeUnix := time.Now().UnixNano()
-	var buffer = make([]byte, fileutil.GetDefaultChunkSize())
-	startTime := time.Now().Unix()
-
-	for i, sOffset := range startOffsetLst {
-		if i == lastChunkIndex {
-			lastChunkSize, err := fileutil.GetLatsChunkSizeInBytes(filePath)
-			if err != nil {
-				log.Panic(err)
+	chunkSize := fileutil.GetDefaultChunkSize()
+	chunkCount := int((_size + chunkSize - 1) / chunkSize)
+	var buffer = make([]byte, chunkSize)
+	started, resumedAt := time.Now(), offset
+
+	for offset < _size {
+		i := int(offset / chunkSize)
+		if ctx.Err() != nil {
+			// 收到中断信号，保存断点后退出，下次运行时从这里继续
+			rs.Resume.Put(resumeKey, fileutil.ResumeItem{UploadURL: uploadURL, Offset: offset, Size: _size, ModTime: stat.ModTime().Unix()})
+			if err := rs.Resume.Save(); err != nil {
+				log.Println(err)
 			}
-			buffer = make([]byte, lastChunkSize)
-			isLastChunk = true
+			notify.Publish(notify.Checkpoint{Path: filePath, Bytes: offset, Size: _size})
+			return uploadResp, httpLocal.ErrInterrupted
 		}
-		filePartInBytes := &buffer
-		//4a. Get the bytes for the file based on the offset 根据偏移量获取文件的字节数
-		err := fileutil.GetFilePartInBytes(filePartInBytes, filePath, sOffset)
-		if err != nil {
-			log.Panicf(locText("failToStore"), err)
+		length := chunkSize
+		if _size-offset < length {
+			length = _size - offset
+		}
+		filePartInBytes := buffer[:length]
+		//3a. Get the bytes for the file based on the offset 根据偏移量获取文件的字节数
+		err := fileutil.GetFilePartInBytes(&filePartInBytes, filePath, offset)
+		if errors.Is(err, fileutil.ErrChanged) {
+			// 文件在上传过程中被改写，已上传的部分作废
+			rs.Resume.Delete(resumeKey)
+			return uploadResp, err
 		}
-		if i != 0 {
-			sendMsg(fmt.Sprintf(locText("oneDriveUploadTip1"), username, filePath, size, byte2Readable(float64(fileutil.GetDefaultChunkSize())*float64(i)), i, len(startOffsetLst), byte2Readable(float64(fileutil.GetDefaultChunkSize())/float64(time.Now().UnixNano()-timeUnix)*float64(1000000000)), time.Now().Unix()-startTime))
-		} else {
-			sendMsg(fmt.Sprintf(locText("oneDriveUploadTip2"), username, filePath, size, "0", i, len(startOffsetLst), time.Now().Unix()-startTime))
+		if err != nil {
+			// 无法读取的文件记为失败，不影响其他文件
+			return uploadResp, err
 		}
 
-		timeUnix = time.Now().UnixNano()
 		//3b. make a call to the upload url with the file part based on the offset. 使用基于偏移量的文件部分调用上载url。
 		var resp *http.Response
 		for errCount := 1; errCount < 10; errCount++ {
-			resp, err = rs.uploadFilePart(uploadURL, filePath, bearerToken, *filePartInBytes, sOffset, isLastChunk)
-			if err != nil {
-				bearerToken = http2.GetBearer() //解决长时上传时，Bearer超时的问题，这里采用超时一次就重新获取一次token的方案
-				sendMsg("close|" + fmt.Sprintf(locText("failToLink"), username, filePath, errCount))
-				// close 用作输出时定位，带有 close 在输出时不会被刷新走
-				// close= 表示文件传输结束，此时会同步删除tg发出的消息
-				// close| 则不会删除消息
-			} else {
+			resp, err = rs.uploadFilePart(ctx, uploadURL, bearerToken, filePartInBytes, offset, _size)
+			if err == nil || ctx.Err() != nil {
 				break
 			}
+			//解决长时上传时，Bearer超时的问题：缓存的token快过期时会自动刷新，收到401时强制刷新
+			if httpLocal.IsUnauthorized(err) {
+				bearerToken = httpLocal.RefreshBearer()
+			} else {
+				bearerToken = httpLocal.GetBearer()
+			}
+			notify.Publish(notify.Retrying{Path: filePath, Reason: "network", Attempt: errCount, Err: err})
 		}
 		if err != nil {
-			log.Fatalf("Failed to Load Files from source :%v", err)
+			if ctx.Err() != nil {
+				// 中断时当前分块没有传完，下次从这个分块重新开始
+				continue
+			}
+			// 重试多次仍然失败时保存断点，这个文件记为失败，下次运行或 -retry-failed 时从这里继续
+			rs.Resume.Put(resumeKey, fileutil.ResumeItem{UploadURL: uploadURL, Offset: offset, Size: _size, ModTime: stat.ModTime().Unix()})
+			if err := rs.Resume.Save(); err != nil {
+				log.Println(err)
+			}
+			return uploadResp, err
 		}
 
 		respMap := make(map[string]interface{})
 		err = json.NewDecoder(resp.Body).Decode(&respMap)
 		if err != nil {
-			fmt.Println(err)
-		}
-		if resp.Body != nil {
-			defer resp.Body.Close()
+			log.Println(err)
 		}
+		httpLocal.DrainBody(resp)
 		//fmt.Printf("%+v, status code: %s", respMap, resp.Status)
 		uploadResp = append(uploadResp, respMap)
+		offset += length
+		elapsed := time.Since(started)
+		notify.Publish(notify.ChunkUploaded{Path: filePath, Size: _size, Bytes: offset, Resumed: resumedAt, Chunk: i + 1, Chunks: chunkCount, Speed: int64(float64(offset-resumedAt) / elapsed.Seconds()), Elapsed: elapsed})
 		debug.FreeOSMemory()
 	}
+	rs.Resume.Delete(resumeKey)
+	return uploadResp, nil
+}
 
-	sendMsg("close=" + fmt.Sprintf(fmt.Sprintf(locText("completeUpload"), filePath, time.Now().Unix()-startTime, byte2Readable(float64(_size)/float64(time.Now().UnixNano()-timeUnix)*float64(1000000000)))))
-	return uploadResp
+//Returns the next offset the upload session expects, used when resuming an interrupted upload
+//返回上传会话期望的下一个偏移量，用于继续被中断的上传
+func (rs *RestoreService) getUploadSessionOffset(ctx context.Context, uploadURL string) (int64, error) {
+	req, err := rs.NewRequest("GET", uploadURL, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := rs.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer httpLocal.DrainBody(resp)
+	status := struct {
+		NextExpectedRanges []string `json:"nextExpectedRanges"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return 0, err
+	}
+	if len(status.NextExpectedRanges) == 0 {
+		return 0, fmt.Errorf("upload session has no expected ranges")
+	}
+	next := strings.SplitN(status.NextExpectedRanges[0], "-", 2)[0]
+	return strconv.ParseInt(next, 10, 64)
 }
 
 //Returns the restore session url for part file upload
-func (rs *RestoreService) getUploadSession(userID string, bearerToken string, conflictOption string, targetFolder string, filePath string) (map[string]interface{}, error) {
-	targetPath := strings.ReplaceAll(filepath.Join(targetFolder, filePath), "\\", "/")
-	uploadSessionPath := fmt.Sprintf(uploadSessionPath, userID, targetPath)
+//A non-empty ifMatch makes the session fail with 412 when the remote file has another eTag
+//A non-empty itemID replaces that item and keeps its name instead of uploading to the remote path of filePath
+func (rs *RestoreService) getUploadSession(ctx context.Context, userID string, bearerToken string, conflictOption string, ifMatch string, itemID string, targetFolder string, filePath string) (map[string]interface{}, error) {
+	targetPath := fileutil.RemotePath(filepath.Join(targetFolder, filePath))
+	uploadSessionPath, name := graphItemPath(userID, targetPath, "createUploadSession"), path.Base(targetPath)
+	if itemID != "" {
+		uploadSessionPath, name = graphItemIDPath(userID, itemID, "createUploadSession"), ""
+	}
 	uploadSessionData := make(map[string]interface{})
 	//Get the body for resemble upload session call.
-	body, err := getRessumableSessionBody(filePath, conflictOption)
+	body, err := getRessumableSessionBody(filePath, name, conflictOption)
 	if err != nil {
 		return nil, err
 	}
@@ -121,19 +187,24 @@ func (rs *RestoreService) getUploadSession(userID string, bearerToken string, co
 	//log.Panicf("%+v", uploadSessionPath)
 
 	//Create request instance
-	req, err := rs.NewRequest("PUT", uploadSessionPath, getRessumableUploadSessionHeader(bearerToken), body)
+	header := getRessumableUploadSessionHeader(bearerToken)
+	if ifMatch != "" {
+		header["If-Match"] = ifMatch
+	}
+	req, err := rs.NewRequest("POST", uploadSessionPath, header, body)
 	//log.Panicf("%+v", req)
 	if err != nil {
 		return nil, err
 	}
 	//Execute the request
-	resp, err := rs.Do(req)
+	resp, err := rs.Do(req.WithContext(ctx))
 	// log.Panicf("%+v", resp)
 	if err != nil {
 		//Need to return a generic object from onedrive upload instead of response directly
 		return nil, err
 	}
 
+	defer httpLocal.DrainBody(resp)
 	//convert http.Response to map
 	err = json.NewDecoder(resp.Body).Decode(&uploadSessionData)
 	if err != nil {
@@ -143,26 +214,15 @@ func (rs *RestoreService) getUploadSession(userID string, bearerToken string, co
 }
 
 //Uploads the file part to Onedrive
-func (rs *RestoreService) uploadFilePart(uploadURL string, filePath string, bearerToken string, filePart []byte, startOffset int64, isLastPart bool) (*http.Response, error) {
-	//This is required for Content-Range header key
-	fileSizeInBytes, err := fileutil.GetFileSize(filePath)
-	if err != nil {
-		return nil, err
-	}
-
-	//Fetch Last chunklength -- will be needed in Content_length header
-	lastChunkLength, err := fileutil.GetLatsChunkSizeInBytes(filePath)
-	if err != nil {
-		return nil, err
-	}
-
+//The part is sent with a detached context, so an interrupt lets the current chunk finish
+func (rs *RestoreService) uploadFilePart(ctx context.Context, uploadURL string, bearerToken string, filePart []byte, startOffset int64, fileSizeInBytes int64) (*http.Response, error) {
 	//Create upload part file request
-	req, err := rs.NewRequest("PUT", uploadURL, getRessumableUploadHeader(fileSizeInBytes, bearerToken, startOffset, isLastPart, lastChunkLength), filePart)
+	req, err := rs.NewRequest("PUT", uploadURL, getRessumableUploadHeader(fileSizeInBytes, bearerToken, startOffset, int64(len(filePart))), filePart)
 	if err != nil {
 		return nil, err
 	}
 	//Execute the request
-	resp, err := rs.Do(req)
+	resp, err := rs.Do(req.WithContext(httpLocal.Detach(ctx)))
 	if err != nil {
 		//Need to return a generic object from onedrive upload instead of response directly
 		return nil, err
@@ -181,17 +241,9 @@ func getRessumableUploadSessionHeader(accessToken string) map[string]string {
 }
 
 //Returns headers for recoverable actual upload as file parts
-func getRessumableUploadHeader(fileSizeInBytes int64, accessToken string, startOffset int64, isLastChunk bool, lastChunkSize int64) map[string]string {
-	var cRange string
-	var cLength string
-
-	if isLastChunk {
-		cRange = fmt.Sprintf("bytes %d-%d/%d", startOffset, fileSizeInBytes-2, fileSizeInBytes-1)
-		cLength = fmt.Sprintf("%d", lastChunkSize)
-	} else {
-		cRange = fmt.Sprintf("bytes %d-%d/%d", startOffset, startOffset+fileutil.GetDefaultChunkSize()-1, fileSizeInBytes-1)
-		cLength = fmt.Sprintf("%d", fileutil.GetDefaultChunkSize())
-	}
+func getRessumableUploadHeader(fileSizeInBytes int64, accessToken string, startOffset int64, chunkSize int64) map[string]string {
+	cRange := fmt.Sprintf("bytes %d-%d/%d", startOffset, startOffset+chunkSize-1, fileSizeInBytes)
+	cLength := fmt.Sprintf("%d", chunkSize)
 
 	// fmt.Printf("\nCLength: %s , cRange: %s\n", cLength, cRange)
 	bearerToken := fmt.Sprintf("bearer %s", accessToken)
@@ -203,32 +255,20 @@ func getRessumableUploadHeader(fileSizeInBytes int64, accessToken string, startO
 }
 
 //Returns the expected body for creating file upload session to onedrive
-func getRessumableSessionBody(filePath string, conflictOption string) (string, error) {
-	bodyMap := map[string]string{"@microsoft.graph.conflictBehavior": conflictOption, "description": "", "name": filePath}
-	jsonBody, err := json.Marshal(bodyMap)
-	return string(jsonBody), err
-}
-
-func byte2Readable(bytes float64) string {
-	const kb float64 = 1024
-	const mb float64 = kb * 1024
-	const gb float64 = mb * 1024
-	var readable float64
-	var unit string
-	_bytes := bytes
-
-	if _bytes >= gb {
-		// xx GB
-		readable = _bytes / gb
-		unit = "GB"
-	} else if _bytes < gb && _bytes >= mb {
-		// xx MB
-		readable = _bytes / mb
-		unit = "MB"
-	} else {
-		// xx KB
-		readable = _bytes / kb
-		unit = "KB"
-	}
-	return strconv.FormatFloat(readable, 'f', 2, 64) + " " + unit
+//The conflict behavior has to be inside "item", otherwise Graph ignores it
+//fileSystemInfo keeps the local created and modified time instead of the upload time
+//An empty name keeps the name of an existing item
+func getRessumableSessionBody(filePath string, name string, conflictOption string) ([]byte, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	item := map[string]interface{}{
+		"@microsoft.graph.conflictBehavior": conflictOption,
+		"fileSystemInfo":                    fileSystemInfo(info),
+	}
+	if name != "" {
+		item["name"] = name
+	}
+	return json.Marshal(map[string]interface{}{"item": item})
 }
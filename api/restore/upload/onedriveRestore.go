@@ -1,59 +1,199 @@
 package upload
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/buger/jsonparser"
 	"io/ioutil"
 	"log"
 	"main/fileutil"
 	httpLocal "main/graph/net/http"
+	"main/notify"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
 const (
-	simpleUploadPath = "/users/%s/drive/root:/%s:/content"
+	itemPath = "/users/%s/drive/items/%s"
 )
 
 func GetRestoreService(c *http.Client) *RestoreService {
 	return &RestoreService{
-		httpLocal.NewOneDriveClient(c, false),
+		OneDrive: httpLocal.NewOneDriveClient(c, false),
 	}
 }
 
 // RestoreService ItemService manages the communication with Item related API endpoints
 type RestoreService struct {
 	*httpLocal.OneDrive
+	// Resume holds the upload sessions of interrupted large files, it may be nil
+	Resume *fileutil.ResumeState
 }
 
-func (rs *RestoreService) GetDriveItem(userId string, bearerToken string, targetFolder string) (map[string]bool, error) {
-	uploadPath := fmt.Sprintf("/users/%s/drive/root:/%s:/children", userId, targetFolder)
-	req, err := rs.NewRequest("GET", uploadPath, getSimpleUploadHeader(bearerToken), nil)
+// DriveItem is the part of a driveItem resource the uploader uses
+type DriveItem struct {
+	ID                   string    `json:"id"`
+	Name                 string    `json:"name"`
+	Size                 int64     `json:"size"`
+	ETag                 string    `json:"eTag"`
+	WebURL               string    `json:"webUrl"`
+	LastModifiedDateTime time.Time `json:"lastModifiedDateTime"`
+	FileSystemInfo       *struct {
+		LastModifiedDateTime time.Time `json:"lastModifiedDateTime"`
+	} `json:"fileSystemInfo"`
+	File *struct {
+		Hashes map[string]string `json:"hashes"`
+	} `json:"file"`
+}
+
+// ModTime returns the modification time of the file as set by the client
+// that uploaded it, falling back to the time it was last changed on the drive
+func (item DriveItem) ModTime() time.Time {
+	if item.FileSystemInfo != nil && !item.FileSystemInfo.LastModifiedDateTime.IsZero() {
+		return item.FileSystemInfo.LastModifiedDateTime
+	}
+	return item.LastModifiedDateTime
+}
+
+// Hash returns the strongest hash the drive reported for the item, OneDrive
+// for Business only has quickXorHash while personal drives may also have sha1Hash
+func (item DriveItem) Hash() (string, string) {
+	if item.File == nil {
+		return "", ""
+	}
+	for _, hashType := range []string{"sha256Hash", "sha1Hash", "quickXorHash"} {
+		if hash := item.File.Hashes[hashType]; hash != "" {
+			return hashType, hash
+		}
+	}
+	return "", ""
+}
+
+// ItemFromResponse extracts the uploaded item from the response of
+// SimpleUploadToOriginalLoc, for a large file it is the response of the last chunk
+func ItemFromResponse(resp interface{}) (DriveItem, bool) {
+	var item DriveItem
+	if parts, ok := resp.([]map[string]interface{}); ok {
+		if len(parts) == 0 {
+			return item, false
+		}
+		resp = parts[len(parts)-1]
+	}
+	data, err := json.Marshal(resp)
+	if err != nil || json.Unmarshal(data, &item) != nil {
+		return item, false
+	}
+	return item, item.ID != ""
+}
+
+// fileSystemInfo returns the fileSystemInfo facet with the local timestamps of info
+func fileSystemInfo(info os.FileInfo) map[string]string {
+	return map[string]string{
+		"createdDateTime":      fileutil.CreationTime(info).UTC().Format(time.RFC3339),
+		"lastModifiedDateTime": info.ModTime().UTC().Format(time.RFC3339),
+	}
+}
+
+// setFileSystemInfo sets the timestamps of the uploaded item itemID to those
+// of the local file, a simple upload can't carry them in the request itself
+func (rs *RestoreService) setFileSystemInfo(ctx context.Context, userId string, bearerToken string, itemID string, info os.FileInfo) (map[string]interface{}, error) {
+	body, err := json.Marshal(map[string]interface{}{"fileSystemInfo": fileSystemInfo(info)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := rs.NewRequest("PATCH", fmt.Sprintf(itemPath, url.PathEscape(userId), url.PathEscape(itemID)), getRessumableUploadSessionHeader(bearerToken), body)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := rs.Do(req)
+	resp, err := rs.Do(req.WithContext(httpLocal.Detach(ctx)))
 	if err != nil {
-		//log.Panicln(err)
 		return nil, err
 	}
-	//s, _ := ioutil.ReadAll(resp.Body)
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	a := make(map[string]bool, 0)
+	defer httpLocal.DrainBody(resp)
+	respMap := make(map[string]interface{})
+	err = json.NewDecoder(resp.Body).Decode(&respMap)
+	return respMap, err
+}
+
+// GetItem returns the item at targetPath, found is false when it does not exist
+func (rs *RestoreService) GetItem(ctx context.Context, userId string, bearerToken string, targetPath string) (DriveItem, bool, error) {
+	var item DriveItem
+	req, err := rs.NewRequest("GET", graphItemPath(userId, targetPath, ""), getSimpleUploadHeader(bearerToken), nil)
+	if err != nil {
+		return item, false, err
+	}
+	resp, err := rs.Do(req.WithContext(ctx))
+	if err != nil {
+		if e, ok := err.(*httpLocal.Error); ok && e.StatusCode == http.StatusNotFound {
+			return item, false, nil
+		}
+		return item, false, err
+	}
+	defer httpLocal.DrainBody(resp)
+	err = json.NewDecoder(resp.Body).Decode(&item)
+	return item, err == nil, err
+}
 
-	jsonparser.ArrayEach(buf.Bytes(), func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-		i, _ := jsonparser.GetString(value, "name")
-		//fmt.Println(i)
-		a[i] = true
-	}, "value")
+// Matches reports whether the item is the same file as the local filePath of
+// size bytes under policy: "name" only needs the item to exist, "size" also
+// compares the size and "hash" compares the hash as well when the drive has one
+func (item DriveItem) Matches(policy string, filePath string, size int64) (bool, error) {
+	if item.File == nil {
+		return false, nil
+	}
+	if policy == "name" {
+		return true, nil
+	}
+	if item.Size != size {
+		return false, nil
+	}
+	hashType, hash := item.Hash()
+	if policy == "size" || hashType == "" {
+		return true, nil
+	}
+	localHash, err := fileutil.HashFile(filePath, hashType)
+	if err != nil {
+		return false, err
+	}
+	return fileutil.SameHash(hashType, localHash, hash), nil
+}
 
-	return a, nil
+// GetDriveItem returns the children of targetFolder by name, following
+// @odata.nextLink so folders with more than one page of children are complete
+func (rs *RestoreService) GetDriveItem(ctx context.Context, userId string, bearerToken string, targetFolder string) (map[string]DriveItem, error) {
+	uploadPath := graphItemPath(userId, targetFolder, "children") + "?$select=id,name,size,eTag,lastModifiedDateTime,fileSystemInfo,file&$top=1000"
+	items := make(map[string]DriveItem, 0)
+	for uploadPath != "" {
+		req, err := rs.NewRequest("GET", uploadPath, getSimpleUploadHeader(bearerToken), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := rs.Do(req.WithContext(ctx))
+		if err != nil {
+			// 还没有创建的文件夹中没有文件
+			if e, ok := err.(*httpLocal.Error); ok && e.StatusCode == http.StatusNotFound {
+				return items, nil
+			}
+			return nil, err
+		}
+		var page struct {
+			Value    []DriveItem `json:"value"`
+			NextLink string      `json:"@odata.nextLink"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		httpLocal.DrainBody(resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Value {
+			items[item.Name] = item
+		}
+		uploadPath = page.NextLink
+	}
+	return items, nil
 }
 
 // SimpleUploadToOriginalLoc allows you to provide the contents of a new file or update the
@@ -65,57 +205,76 @@ func (rs *RestoreService) GetDriveItem(userId string, bearerToken string, target
 //@bearerToken will be extracted as sent from the restore input xml
 //@filePath will be extracted from the file hierarchy the needs to be restored
 //@fileInfo it is the file info struct that contains the actual file reference and the size_type
-func (rs *RestoreService) SimpleUploadToOriginalLoc(userId string, bearerToken string, conflictOption string, targetFolder string, filePath string, fileInfo fileutil.FileInfo, sendMsg func(text string), locText func(text string) string, username string) interface{} {
+//@ifMatch is the eTag the remote file must still have, empty to upload unconditionally
+//@itemID is the item an earlier upload of the file created, it is replaced instead of the item at the remote path of filePath
+//Cancelling ctx stops the upload at the next chunk boundary and returns ErrInterrupted
+func (rs *RestoreService) SimpleUploadToOriginalLoc(ctx context.Context, userId string, bearerToken string, conflictOption string, ifMatch string, itemID string, targetFolder string, filePath string, fileInfo fileutil.FileInfo, locText func(text string) string) (interface{}, error) {
 	if fileInfo.SizeType == fileutil.SizeTypeLarge {
 		//For Large file type use resemble onedrive upload API
 		//log.Printf("Processing Large File: %s", filePath)
-		sendMsg(fmt.Sprintf(locText("oneDriveBigFile"), filePath, username))
-		return rs.recoverableUpload(userId, bearerToken, conflictOption, targetFolder, filePath, fileInfo, sendMsg, locText, username)
+		return rs.recoverableUpload(ctx, userId, bearerToken, conflictOption, ifMatch, itemID, targetFolder, filePath, fileInfo, locText)
 	} else {
 		//log.Printf("Processing Small File: %s", filePath)
-		sendMsg(fmt.Sprintf(locText("oneDriveSmallFile"), filePath, username))
-		targetPath := strings.ReplaceAll(filepath.Join(targetFolder, filePath), "\\", "/")
-		startTime := time.Now().Unix()
-		_size, err := fileutil.GetFileSize(filePath)
-		uploadPath := fmt.Sprintf(simpleUploadPath, userId, targetPath)
-		req, err := rs.NewRequest("PUT", uploadPath, getSimpleUploadHeader(bearerToken), fileInfo.FileData)
+		targetPath := fileutil.RemotePath(filepath.Join(targetFolder, filePath))
+		uploadPath := graphItemPath(userId, targetPath, "content")
+		if itemID != "" {
+			uploadPath = graphItemIDPath(userId, itemID, "content")
+		}
+		fileData, err := fileutil.ReadFile(fileInfo.FileData)
 		if err != nil {
-			log.Panicf(locText("failToStore"), err)
+			// 文件在扫描后被删除或截断，交给调用方决定是否重新上传
+			return nil, err
 		}
 		//Handle query parameter for conflict resolution 冲突解决的句柄查询参数
 		//The different values for @microsoft.graph.conflictBehavior= rename|replace|fail
 		q := url.Values{}
 		q.Add("@microsoft.graph.conflictBehavior", conflictOption)
-		req.URL.RawQuery = q.Encode()
 
-		//Execute the request
+		//Execute the request, a small file is always finished even if an interrupt arrives
+		//每次重试都重新创建请求，401 时刷新 token 后再试
 		var resp *http.Response
 		for errCount := 1; errCount < 10; errCount++ {
-			resp, err = rs.Do(req)
-			if err != nil {
-				sendMsg(fmt.Sprintf(locText("failToLink"), username, filePath, errCount))
-			} else {
+			header := getSimpleUploadHeader(bearerToken)
+			if ifMatch != "" {
+				header["If-Match"] = ifMatch
+			}
+			req, reqErr := rs.NewRequest("PUT", uploadPath, header, fileData)
+			if reqErr != nil {
+				return nil, reqErr
+			}
+			req.URL.RawQuery = q.Encode()
+			resp, err = rs.Do(req.WithContext(httpLocal.Detach(ctx)))
+			if err == nil || httpLocal.IsConflict(err) {
+				// 冲突是网盘中文件的状态决定的，重试没有意义
 				break
 			}
-
+			if httpLocal.IsUnauthorized(err) {
+				bearerToken = httpLocal.RefreshBearer()
+			}
+			notify.Publish(notify.Retrying{Path: filePath, Reason: "network", Attempt: errCount, Err: err})
 		}
 
 		if err != nil {
-			sendMsg(fmt.Sprintf(locText("filenameFail"), filePath))
-			return nil
-		}
-		if resp.Body != nil {
-			defer resp.Body.Close()
+			return nil, err
 		}
+		defer httpLocal.DrainBody(resp)
 		//Convert to simple map
 		respMap := make(map[string]interface{})
 		err = json.NewDecoder(resp.Body).Decode(&respMap)
 		if err != nil {
 			log.Panicf(locText("failToStore"), err)
 		}
-		timeUnix := time.Now().UnixNano()
-		sendMsg("close=" + fmt.Sprintf(fmt.Sprintf(locText("completeUpload"), filePath, time.Now().Unix()-startTime, byte2Readable(float64(_size)/float64(time.Now().UnixNano()-timeUnix)*float64(1000000000)))))
-		return respMap
+		//简单上传无法携带文件时间，上传后再用 PATCH 设置为本地文件的时间
+		if info, err := fileInfo.FileData.Stat(); err == nil {
+			if id, ok := respMap["id"].(string); ok {
+				if item, err := rs.setFileSystemInfo(ctx, userId, bearerToken, id, info); err == nil {
+					respMap = item
+				} else {
+					log.Println(err)
+				}
+			}
+		}
+		return respMap, nil
 	}
 
 }
@@ -126,16 +285,17 @@ func (rs *RestoreService) SimpleUploadToOriginalLoc(userId string, bearerToken s
 //@userId will be extracted as sent from the restore input xml
 //@filePath will be extracted from the file hierarchy the needs to be restored
 //@fileInfo it is the file info struct that contains the actual file reference and the size_type
-func (rs *RestoreService) SimpleUploadToAlternateLoc(altUserId string, bearerToken string, targetFolder string, conflictOption string, filePath string, fileInfo fileutil.FileInfo, sendMsg func(text string), locText func(text string) string, username string) interface{} {
+func (rs *RestoreService) SimpleUploadToAlternateLoc(ctx context.Context, altUserId string, bearerToken string, targetFolder string, conflictOption string, filePath string, fileInfo fileutil.FileInfo, locText func(text string) string) interface{} {
 	if fileInfo.SizeType == fileutil.SizeTypeLarge {
 		//For Large file type use resemble onedrive upload API
-		return rs.recoverableUpload(altUserId, bearerToken, conflictOption, targetFolder, filePath, fileInfo, sendMsg, locText, username)
+		resp, _ := rs.recoverableUpload(ctx, altUserId, bearerToken, conflictOption, "", "", targetFolder, filePath, fileInfo, locText)
+		return resp
 	} else {
 
-		uploadPath := fmt.Sprintf(simpleUploadPath, altUserId, filePath)
+		uploadPath := graphItemPath(altUserId, fileutil.RemotePath(filePath), "content")
 		req, err := rs.NewRequest("PUT", uploadPath, getSimpleUploadHeader(bearerToken), fileInfo.FileData)
 		if err != nil {
-			log.Panicf("Failed to Restore :%v", err)
+			log.Panicf(locText("failToStore"), err)
 		}
 		//Handle query parameter for conflict resolution
 		//The different values for @microsoft.graph.conflictBehavior= rename|replace|fail
@@ -144,18 +304,16 @@ func (rs *RestoreService) SimpleUploadToAlternateLoc(altUserId string, bearerTok
 		req.URL.RawQuery = q.Encode()
 
 		//Execute the request
-		resp, err := rs.Do(req)
+		resp, err := rs.Do(req.WithContext(ctx))
 		if err != nil {
-			log.Panicf("Failed to Restore :%v", err)
-		}
-		if resp.Body != nil {
-			defer resp.Body.Close()
+			log.Panicf(locText("failToStore"), err)
 		}
+		defer httpLocal.DrainBody(resp)
 		//Convert to simple map
 		respMap := make(map[string]interface{})
 		err = json.NewDecoder(resp.Body).Decode(&respMap)
 		if err != nil {
-			log.Panicf("Failed to Restore :%v", err)
+			log.Panicf(locText("failToStore"), err)
 		}
 		return respMap
 	}
@@ -163,7 +321,7 @@ func (rs *RestoreService) SimpleUploadToAlternateLoc(altUserId string, bearerTok
 
 //Get response as string
 func readRespAsString(resp *http.Response) string {
-	defer resp.Body.Close()
+	defer httpLocal.DrainBody(resp)
 	if resp.StatusCode == http.StatusOK {
 		bodyBytes, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
@@ -0,0 +1,185 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"main/fileutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDrive is a drive with one folder "target" that creates, renames and
+// replaces files like Graph does for simple uploads and upload sessions
+type fakeDrive struct {
+	mutex    sync.Mutex
+	url      string
+	names    map[string]string
+	data     map[string]string
+	sessions map[string]string
+	nextID   int
+}
+
+func newFakeDrive(t *testing.T) (*fakeDrive, *RestoreService) {
+	fake := &fakeDrive{names: make(map[string]string), data: make(map[string]string), sessions: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	fake.url = srv.URL
+	rs := GetRestoreService(srv.Client())
+	rs.BaseURL = srv.URL
+	return fake, rs
+}
+
+// put stores data as the file name in the folder, conflict is the
+// conflictBehavior used when the name is taken
+func (f *fakeDrive) put(name string, data string, conflict string) (string, int) {
+	id, ok := f.names[name]
+	if ok && conflict == "fail" {
+		return "", http.StatusConflict
+	}
+	if ok && conflict == "rename" {
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 1; ok; i++ {
+			name = fmt.Sprintf("%s %d%s", base, i, ext)
+			_, ok = f.names[name]
+		}
+	}
+	if !ok {
+		f.nextID++
+		id = fmt.Sprint(f.nextID)
+		f.names[name] = id
+	}
+	f.data[id] = data
+	return id, http.StatusCreated
+}
+
+// item returns the JSON of the item id
+func (f *fakeDrive) item(id string) map[string]interface{} {
+	for name, itemID := range f.names {
+		if itemID == id {
+			return map[string]interface{}{"id": id, "name": name, "size": len(f.data[id])}
+		}
+	}
+	return map[string]interface{}{"id": id}
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	conflict := r.URL.Query().Get("@microsoft.graph.conflictBehavior")
+	folder, items := "/users/u/drive/root:/target/", "/users/u/drive/items/"
+	id, status := "", http.StatusOK
+	switch p := r.URL.Path; {
+	case r.Method == "PUT" && strings.HasPrefix(p, folder) && strings.HasSuffix(p, ":/content"):
+		id, status = f.put(strings.TrimSuffix(strings.TrimPrefix(p, folder), ":/content"), string(body), conflict)
+	case r.Method == "PUT" && strings.HasPrefix(p, items) && strings.HasSuffix(p, "/content"):
+		id = strings.TrimSuffix(strings.TrimPrefix(p, items), "/content")
+		f.data[id] = string(body)
+	case r.Method == "PATCH" && strings.HasPrefix(p, items):
+		id = strings.TrimPrefix(p, items)
+	case r.Method == "POST" && strings.HasSuffix(p, "createUploadSession"):
+		// 会话记录上传完成后写入的位置：已有项目的 ID，或文件名和冲突处理方式
+		var session struct {
+			Item map[string]interface{} `json:"item"`
+		}
+		_ = json.Unmarshal(body, &session)
+		target := strings.TrimSuffix(strings.TrimPrefix(p, items), "/createUploadSession")
+		if strings.HasPrefix(p, folder) {
+			if _, ok := session.Item["name"]; !ok {
+				status = http.StatusBadRequest
+				break
+			}
+			target = fmt.Sprintf("%s\n%s", session.Item["name"], session.Item["@microsoft.graph.conflictBehavior"])
+		}
+		key := fmt.Sprint(len(f.sessions) + 1)
+		f.sessions[key] = target
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"uploadUrl": f.url + "/session/" + key})
+		return
+	case r.Method == "PUT" && strings.HasPrefix(p, "/session/"):
+		target := f.sessions[strings.TrimPrefix(p, "/session/")]
+		if parts := strings.SplitN(target, "\n", 2); len(parts) == 2 {
+			id, status = f.put(parts[0], string(body), parts[1])
+		} else {
+			id, status = target, http.StatusCreated
+			f.data[id] = string(body)
+		}
+	default:
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if status >= http.StatusBadRequest {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": "error", "message": r.Method + " " + r.URL.Path}})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(f.item(id))
+}
+
+// TestRenameRequeueReplacesCreatedItem uploads a file with conflict behavior
+// rename next to an existing file of the same name, then uploads its new
+// content again with the ID of the created item as a requeued file does
+func TestRenameRequeueReplacesCreatedItem(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	locText := func(text string) string { return text }
+
+	for _, sizeType := range []string{fileutil.SizeTypeSmall, fileutil.SizeTypeLarge} {
+		fake, rs := newFakeDrive(t)
+		fake.put("a.txt", "theirs", "fail")
+		upload := func(data string, conflictOption string, itemID string) DriveItem {
+			if err := ioutil.WriteFile("a.txt", []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open("a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info := fileutil.FileInfo{Path: "a.txt", FileData: f, SizeType: sizeType, Size: int64(len(data))}
+			resp, err := rs.SimpleUploadToOriginalLoc(context.Background(), "u", "token", conflictOption, "", itemID, "target", "a.txt", info, locText)
+			if err != nil {
+				t.Fatalf("%s upload %q: %v", sizeType, data, err)
+			}
+			item, ok := ItemFromResponse(resp)
+			if !ok {
+				t.Fatalf("%s upload %q: no item in %v", sizeType, data, resp)
+			}
+			return item
+		}
+
+		created := upload("first", "rename", "")
+		if created.Name != "a 1.txt" {
+			t.Errorf("%s: renamed upload created %q", sizeType, created.Name)
+		}
+		// 上传后文件被改写，重新排队后覆盖第一次创建的项目
+		replaced := upload("second", "replace", created.ID)
+		if replaced.ID != created.ID || replaced.Name != "a 1.txt" {
+			t.Errorf("%s: requeued upload wrote %q %q", sizeType, replaced.ID, replaced.Name)
+		}
+		if got := fake.data[fake.names["a.txt"]]; got != "theirs" {
+			t.Errorf("%s: existing a.txt has %q", sizeType, got)
+		}
+		if got := fake.data[created.ID]; got != "second" {
+			t.Errorf("%s: renamed copy has %q", sizeType, got)
+		}
+		if len(fake.names) != 2 {
+			t.Errorf("%s: drive has %v", sizeType, fake.names)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"main/fileutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// conflictPolicies 是 -m 和规则中可以使用的冲突策略
+// replace、rename 和 fail 直接交给 Graph 的 conflictBehavior 处理，
+// 其余策略需要先读取网盘中同名文件的信息
+var conflictPolicies = map[string]bool{
+	"replace": false,
+	"rename":  false,
+	"fail":    false,
+	"skip":    true,
+	"newer":   true,
+	"larger":  true,
+	"ifmatch": true,
+}
+
+// conflictRule applies policy to the files whose path matches pattern
+type conflictRule struct {
+	pattern string
+	policy  string
+}
+
+// conflictRules are checked in order, the first matching rule wins and files
+// no rule matches use the -m policy
+var conflictRules []conflictRule
+
+// parseConflictPolicy accepts a policy name, and 0 and 1 as the old names of
+// replace and skip
+func parseConflictPolicy(policy string) (string, error) {
+	switch policy {
+	case "0":
+		return "replace", nil
+	case "1":
+		return "skip", nil
+	}
+	if _, ok := conflictPolicies[policy]; !ok {
+		return "", fmt.Errorf(loc.print("invalidConflictPolicy"), policy)
+	}
+	return policy, nil
+}
+
+// addConflictRule parses a rule written as pattern=policy
+func addConflictRule(rule string) error {
+	i := strings.LastIndex(rule, "=")
+	if i <= 0 {
+		return fmt.Errorf(loc.print("invalidConflictRule"), rule)
+	}
+	policy, err := parseConflictPolicy(rule[i+1:])
+	if err != nil {
+		return err
+	}
+	pattern := rule[:i]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf(loc.print("invalidConflictRule"), rule)
+	}
+	conflictRules = append(conflictRules, conflictRule{pattern: pattern, policy: policy})
+	return nil
+}
+
+// match reports whether the rule applies to filePath. A pattern ending with /
+// matches everything below that directory, a pattern without / is matched
+// against the file name, other patterns against the whole path.
+func (r conflictRule) match(filePath string) bool {
+	if strings.HasSuffix(r.pattern, "/") {
+		return strings.HasPrefix(filePath, r.pattern) || strings.Contains(filePath, "/"+r.pattern)
+	}
+	name := filePath
+	if !strings.Contains(r.pattern, "/") {
+		name = path.Base(filePath)
+	}
+	ok, _ := path.Match(r.pattern, name)
+	return ok
+}
+
+// conflictPolicy returns the policy for the local file filePath
+func conflictPolicy(filePath string) string {
+	filePath = strings.ReplaceAll(filePath, "\\", "/")
+	for _, rule := range conflictRules {
+		if rule.match(filePath) {
+			return rule.policy
+		}
+	}
+	return mode
+}
+
+// ruleFlags collects every value of a repeatable flag such as -rule
+type ruleFlags []string
+
+func (r *ruleFlags) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *ruleFlags) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+// collisionResolver applies the -collision resolution to the files of a scan
+// as they are found. OneDrive ignores case and Unicode normalization, so files
+// whose remote paths only differ in those would overwrite each other. The scan
+// is in lexical order and the first file of every group is uploaded as it is.
+type collisionResolver struct {
+	targetFolder string
+	// taken 记录已经分配的网盘路径，值为使用它的本地文件
+	taken map[string]string
+}
+
+func newCollisionResolver(targetFolder string) *collisionResolver {
+	return &collisionResolver{targetFolder: targetFolder, taken: make(map[string]string)}
+}
+
+func (c *collisionResolver) remote(p string) string {
+	return fileutil.RemotePath(filepath.Join(c.targetFolder, p))
+}
+
+// resolve reports whether the local file p is uploaded, a colliding file is
+// renamed or skipped
+func (c *collisionResolver) resolve(p string) bool {
+	remote := c.remote(p)
+	key := fileutil.CollisionKey(remote)
+	first, ok := c.taken[key]
+	if !ok {
+		c.taken[key] = p
+		return true
+	}
+	log.Printf(loc.print("collisionFound"), first+"`, `"+p)
+	if collision == "skip" {
+		log.Printf(loc.print("collisionSkip"), p)
+		return false
+	}
+	// CollisionName 每次给出下一个编号，直到找到没有被占用的名字
+	tried := make(map[string]bool)
+	for {
+		renamed := fileutil.CollisionName(remote, tried)
+		if _, ok := c.taken[fileutil.CollisionKey(renamed)]; !ok {
+			c.taken[fileutil.CollisionKey(renamed)] = p
+			fileutil.OverrideRemotePath(filepath.Join(c.targetFolder, p), renamed)
+			log.Printf(loc.print("collisionRename"), p, renamed)
+			return true
+		}
+	}
+}
+
+// checkCollisions looks for colliding files below source before anything is
+// uploaded, used by -collision abort. No file is opened.
+func checkCollisions(source string, targetFolder string) error {
+	var localPaths []string
+	// 无法读取的文件夹在上传时的扫描中记为失败
+	fileutil.SetUnreadable(func(p string, err error) {})
+	err := fileutil.WalkSource(source, nil, func(p string, info os.FileInfo) error {
+		localPaths = append(localPaths, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	collisions := fileutil.FindCollisions(localPaths, func(p string) string {
+		return fileutil.RemotePath(filepath.Join(targetFolder, p))
+	})
+	for _, group := range collisions {
+		log.Printf(loc.print("collisionFound"), strings.Join(group, "`, `"))
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf(loc.print("collisionAbort"), len(collisions))
+	}
+	return nil
+}
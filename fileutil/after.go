@@ -0,0 +1,130 @@
+package fileutil
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// ErrNotVerified means the uploaded file does not match the local file, the
+// local file is kept
+var ErrNotVerified = errors.New("uploaded file does not match the local file")
+
+// ErrNotOnDrive means a file skipped because of the index is no longer on
+// the drive, the local file is kept
+var ErrNotOnDrive = errors.New("uploaded file is no longer on the drive")
+
+var (
+	deleteAfter bool
+	moveAfter   string
+	// finished counts the local files deleted or moved after their upload
+	finished int64
+)
+
+// SetAfterUpload makes FinishSource delete the local files after their upload
+// or move them under moveTo, keeping their path relative to the source
+func SetAfterUpload(remove bool, moveTo string) {
+	deleteAfter, moveAfter = remove, moveTo
+}
+
+// AfterUpload reports whether the local files are deleted or moved after their upload
+func AfterUpload() bool {
+	return deleteAfter || moveAfter != ""
+}
+
+// FinishedSources returns how many local files were deleted or moved
+func FinishedSources() int64 {
+	return atomic.LoadInt64(&finished)
+}
+
+// FinishSource deletes or moves the local file p once its upload completed.
+// rel is the path of p under the source folder. The uploaded file must have
+// the same size, and the same hash when the drive reports one, otherwise p is
+// kept and ErrNotVerified is returned.
+func FinishSource(p string, rel string, size int64, hashType string, hash string) error {
+	if !AfterUpload() {
+		return nil
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return ErrNotVerified
+	}
+	if hashType != "" && hash != "" {
+		localHash, err := HashFile(p, hashType)
+		if err != nil {
+			return err
+		}
+		if !SameHash(hashType, localHash, hash) {
+			return ErrNotVerified
+		}
+	}
+	if moveAfter != "" {
+		err = moveFile(p, filepath.Join(moveAfter, rel))
+	} else {
+		err = os.Remove(p)
+	}
+	if err == nil {
+		atomic.AddInt64(&finished, 1)
+	}
+	return err
+}
+
+// moveFile moves src to dst, creating the parent folders of dst. Across file
+// systems the file is copied and then removed.
+func moveFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	_ = os.Chtimes(dst, info.ModTime(), info.ModTime())
+	_ = in.Close()
+	return os.Remove(src)
+}
+
+// RemoveEmptyDirs removes the folders under root left empty after their files
+// were deleted or moved, deepest first. root itself and symlinks are kept.
+func RemoveEmptyDirs(root string) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		RemoveEmptyDirs(dir)
+		if rest, err := os.ReadDir(dir); err == nil && len(rest) == 0 {
+			_ = os.Remove(dir)
+		}
+	}
+}
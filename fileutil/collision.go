@@ -0,0 +1,78 @@
+package fileutil
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// remoteOverrides 保存因为冲突被重命名的文件在网盘中的路径
+var remoteOverrides = make(map[string]string)
+var overrideMutex sync.RWMutex
+
+// CollisionKey returns the key under which OneDrive considers two paths the
+// same: it ignores case and Unicode normalization, so NFC and NFD forms match
+func CollisionKey(p string) string {
+	return strings.ToLower(norm.NFC.String(p))
+}
+
+// FindCollisions groups the local paths whose remote paths collide, remote
+// returns the remote path of a local one. Every group is sorted and holds at
+// least two paths, the groups are sorted by their first path.
+func FindCollisions(localPaths []string, remote func(string) string) [][]string {
+	groups := make(map[string][]string)
+	for _, p := range localPaths {
+		key := CollisionKey(remote(p))
+		groups[key] = append(groups[key], p)
+	}
+	var collisions [][]string
+	for _, group := range groups {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i][0] < collisions[j][0]
+	})
+	return collisions
+}
+
+// CollisionName returns a variant of remotePath, such as "a (1).txt", whose
+// collision key is not in taken, and adds it to taken
+func CollisionName(remotePath string, taken map[string]bool) string {
+	dir, name := path.Split(remotePath)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s%s (%d)%s", dir, stem, i, ext)
+		if key := CollisionKey(candidate); !taken[key] {
+			taken[key] = true
+			return candidate
+		}
+	}
+}
+
+// OverrideRemotePath makes RemotePath(p) return remote, used for files renamed
+// because of a collision. The new name is recorded in the name mapping.
+func OverrideRemotePath(p string, remote string) {
+	overrideMutex.Lock()
+	remoteOverrides[p] = remote
+	overrideMutex.Unlock()
+	if err := nameMapping.Record(remote, filepath.ToSlash(p)); err != nil {
+		log.Println(err)
+	}
+}
+
+func remoteOverride(p string) (string, bool) {
+	overrideMutex.RLock()
+	defer overrideMutex.RUnlock()
+	remote, ok := remoteOverrides[p]
+	return remote, ok
+}
@@ -0,0 +1,18 @@
+//go:build darwin
+// +build darwin
+
+package fileutil
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// CreationTime returns when the file was created
+func CreationTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Birthtimespec.Unix())
+	}
+	return info.ModTime()
+}
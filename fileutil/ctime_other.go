@@ -0,0 +1,15 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package fileutil
+
+import (
+	"os"
+	"time"
+)
+
+// CreationTime returns when the file was created. The creation time is not
+// available from os.Stat here, so the modification time is used instead.
+func CreationTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package fileutil
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// CreationTime returns when the file was created
+func CreationTime(info os.FileInfo) time.Time {
+	if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, data.CreationTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,10 +15,16 @@ const SizeTypeSmall = "SMALL"
 
 var defaultChunkSize = int64(10 * 1024 * 1024)
 var timeOut = 60
+var minSpeed = 32
 
+// FileInfo is a file to upload, FileData is only opened when its upload starts
 type FileInfo struct {
+	Path     string
 	FileData *os.File
 	SizeType string
+	// 扫描时的大小和修改时间，上传前后用来判断文件是否仍在写入
+	Size    int64
+	ModTime time.Time
 }
 
 func GetDefaultChunkSize() int64 {
@@ -36,39 +42,68 @@ func SetTimeOut(times int) int {
 	return timeOut
 }
 
-func GetAllUploadItemsFrmSource(sourcePath string) (map[string]FileInfo, error) {
-	fileMap := make(map[string]FileInfo)
-	err := filepath.Walk(sourcePath,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				//Create FileInfo object
-				fileInfo := FileInfo{
-					SizeType: SizeTypeSmall,
-				}
-				//If file size is greater than 4 mb return error
-				//for now until there is a support for Large file upload.
-				if info.Size() > maxFileSizeInBytes {
-					fileInfo.SizeType = SizeTypeLarge
-					//return fmt.Errorf("File %s size  %d > 4Mb is not allowed for simple Restore", info.Name(), info.Size())
-				}
-				fileItem, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				//parentDir := filepath.Dir(path)
-				//fmt.Println(parentDir)
-				fileInfo.FileData = fileItem
-				fileMap[path] = fileInfo
-			}
-			return nil
-		})
-	if err != nil {
-		return nil, err
+// GetMinSpeed 返回可接受的最低上传速度，单位 KB/s
+func GetMinSpeed() int {
+	return minSpeed
+}
+func SetMinSpeed(KB int) int {
+	minSpeed = KB
+	return minSpeed
+}
+
+// ScanStats counts the files found by ScanUploadItems while the scan runs
+type ScanStats struct {
+	Files int64
+	Size  int64
+	done  chan struct{}
+}
+
+// NewScanStats returns the stats of a scan that has not started yet
+func NewScanStats() *ScanStats {
+	return &ScanStats{done: make(chan struct{})}
+}
+
+// Add counts a file of size bytes
+func (s *ScanStats) Add(size int64) {
+	atomic.AddInt64(&s.Files, 1)
+	atomic.AddInt64(&s.Size, size)
+}
+
+// Finish marks the scan as complete, Done is closed afterwards
+func (s *ScanStats) Finish() {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
 	}
-	return fileMap, nil
+}
+
+// Done is closed when the scan is complete and Files and Size are final
+func (s *ScanStats) Done() <-chan struct{} {
+	return s.done
+}
+
+// ScanUploadItems walks sourcePath with WalkSource and sends every file to
+// items without opening it, so the number of open files and the memory used
+// don't grow with the tree. onDir is called for every directory before any file in it is sent,
+// files accept returns false for are left out. Both may be nil.
+// items is closed and stats is finished when the walk ends.
+func ScanUploadItems(sourcePath string, onDir func(dir string) error, accept func(path string) bool, items chan<- FileInfo, stats *ScanStats) error {
+	defer stats.Finish()
+	defer close(items)
+	return WalkSource(sourcePath, onDir, func(path string, info os.FileInfo) error {
+		if accept != nil && !accept(path) {
+			return nil
+		}
+		stats.Add(info.Size())
+		items <- FileInfo{
+			Path:     path,
+			SizeType: sizeType(info.Size()),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		}
+		return nil
+	})
 }
 
 //GetFilePartInBytes can returns the file in parts based on the provided offset
@@ -90,11 +125,15 @@ func GetFilePartInBytes(buffer *[]byte, filePath string, startingOffset int64) e
 		//buffer = make([]byte, default_chunk_size)
 	}*/
 
-	_, err = file.ReadAt(*buffer, startingOffset)
+	n, err := file.ReadAt(*buffer, startingOffset)
 	if err != nil {
 		if err != io.EOF {
 			return fmt.Errorf("readAt: %v", err)
 		}
+		if n < len(*buffer) {
+			// 文件在上传过程中变短了
+			return fmt.Errorf("readAt %s: %w", filePath, ErrChanged)
+		}
 	}
 	return nil
 }
@@ -174,7 +213,11 @@ func ReadFile(file *os.File) ([]byte, error) {
 	filesize := fileinfo.Size()
 	buffer := make([]byte, filesize)
 
-	_, err = file.Read(buffer)
+	// 总是从头读取完整的文件，重新上传时也能读到全部内容
+	_, err = io.ReadFull(io.NewSectionReader(file, 0, filesize), buffer)
+	if err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read %s: %w", file.Name(), ErrChanged)
+	}
 	if err != nil {
 		return nil, err
 	}
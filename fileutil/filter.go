@@ -0,0 +1,533 @@
+package fileutil
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IgnoreFileName is the name of the per-directory ignore files, they use the
+// gitignore syntax and apply to the directory they are in and everything below
+const IgnoreFileName = ".lightignore"
+
+// filterRule is an -include or -exclude pattern or a line of an ignore file
+type filterRule struct {
+	// source 是报告中显示的规则
+	source  string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+	files   int64
+	dirs    int64
+}
+
+// match reports whether the slash separated path rel matches the rule
+func (r *filterRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return r.re.MatchString(rel)
+}
+
+func (r *filterRule) count(isDir bool) {
+	if isDir {
+		atomic.AddInt64(&r.dirs, 1)
+	} else {
+		atomic.AddInt64(&r.files, 1)
+	}
+}
+
+// Filter decides which files of a scan are uploaded
+type Filter struct {
+	includes []*filterRule
+	excludes []*filterRule
+	// 不匹配任何 -include 的文件记在 notIncluded 中
+	notIncluded      *filterRule
+	minSize, maxSize int64
+	sizeRule         *filterRule
+	minAge, maxAge   time.Duration
+	ageRule          *filterRule
+	// -retry-failed 只上传 only 中的文件，onlyDirs 是它们所在的文件夹
+	only, onlyDirs map[string]bool
+
+	root    string
+	now     time.Time
+	mutex   sync.Mutex
+	ignores map[string][]*filterRule
+	// readIgnores 按读取顺序保存所有忽略文件中的规则，用于报告
+	readIgnores []*filterRule
+}
+
+var filter = &Filter{}
+
+// SetFilter makes the scans use f
+func SetFilter(f *Filter) {
+	filter = f
+}
+
+// NewFilter returns a filter uploading the files that match one of includes,
+// if there are any, and none of excludes. A pattern starting with re: is a
+// regular expression matched against the path relative to the uploaded
+// folder, others use the gitignore syntax. Sizes like 10M and ages like 7d
+// that are empty are not checked.
+func NewFilter(includes []string, excludes []string, minSize string, maxSize string, minAge string, maxAge string) (*Filter, error) {
+	f := &Filter{}
+	for _, pattern := range includes {
+		rule, err := parseFilterRule(pattern, "-include "+pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.includes = append(f.includes, rule)
+	}
+	if len(f.includes) > 0 {
+		f.notIncluded = &filterRule{source: "-include"}
+	}
+	for _, pattern := range excludes {
+		rule, err := parseFilterRule(pattern, "-exclude "+pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.excludes = append(f.excludes, rule)
+	}
+	var err error
+	if f.minSize, err = ParseSize(minSize); err != nil {
+		return nil, err
+	}
+	if f.maxSize, err = ParseSize(maxSize); err != nil {
+		return nil, err
+	}
+	if f.minSize > 0 || f.maxSize > 0 {
+		f.sizeRule = &filterRule{source: flagSource("-min-size", minSize, "-max-size", maxSize)}
+	}
+	if f.minAge, err = ParseAge(minAge); err != nil {
+		return nil, err
+	}
+	if f.maxAge, err = ParseAge(maxAge); err != nil {
+		return nil, err
+	}
+	if f.minAge > 0 || f.maxAge > 0 {
+		f.ageRule = &filterRule{source: flagSource("-min-age", minAge, "-max-age", maxAge)}
+	}
+	return f, nil
+}
+
+// flagSource shows the given flags of a pair like -min-size and -max-size
+func flagSource(minFlag string, min string, maxFlag string, max string) string {
+	var parts []string
+	if min != "" {
+		parts = append(parts, minFlag+" "+min)
+	}
+	if max != "" {
+		parts = append(parts, maxFlag+" "+max)
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseFilterRule parses an -include or -exclude pattern
+func parseFilterRule(pattern string, source string) (*filterRule, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(pattern[3:])
+		if err != nil {
+			return nil, err
+		}
+		return &filterRule{source: source, re: re}, nil
+	}
+	rule, err := parseIgnoreLine(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	if rule == nil || rule.negate {
+		return nil, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	rule.source = source
+	return rule, nil
+}
+
+// parseIgnoreLine converts a line in the gitignore syntax to a rule, blank
+// lines and comments give nil
+func parseIgnoreLine(line string) (*filterRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	rule := &filterRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+	// 中间或开头带 / 的规则相对于所在目录，否则匹配任意层级
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	expr, err := globToRegexp(line)
+	if err != nil {
+		return nil, err
+	}
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	if rule.re, err = regexp.Compile(expr); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// globToRegexp converts a gitignore glob to a regular expression, * and ?
+// don't match / while ** matches any number of directories
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		rest := string(runes[i:])
+		switch {
+		case strings.HasPrefix(rest, "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(rest, "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '\\' && i+1 < len(runes):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case c == '[':
+			class, n, err := globClass(runes[i:])
+			if err != nil {
+				return "", err
+			}
+			if n == 0 {
+				// 没有结束的 [ 按普通字符处理
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(class)
+			i += n - 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
+
+// posixClasses 是方括号中可以使用的 [:name:] 字符类
+var posixClasses = map[string]bool{
+	"alnum": true, "alpha": true, "blank": true, "cntrl": true, "digit": true, "graph": true,
+	"lower": true, "print": true, "punct": true, "space": true, "upper": true, "xdigit": true,
+}
+
+// globClass converts the bracket expression at the start of glob to a
+// regular expression and returns how many runes it takes, 0 when the bracket
+// is not closed. A ] right after [ or [! is a member, a reversed range like
+// z-a matches nothing and [:digit:] style classes are kept.
+func globClass(glob []rune) (string, int, error) {
+	i := 1
+	negate := false
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		negate = true
+		i++
+	}
+	var members strings.Builder
+	for first := true; i < len(glob); i, first = i+1, false {
+		c := glob[i]
+		if c == ']' && !first {
+			if negate {
+				// 与 * 和 ? 一样不匹配 /
+				return "[^/" + members.String() + "]", i + 1, nil
+			}
+			if members.Len() == 0 {
+				return `[^\x00-\x{10FFFF}]`, i + 1, nil
+			}
+			return "[" + members.String() + "]", i + 1, nil
+		}
+		if c == '[' && i+1 < len(glob) && glob[i+1] == ':' {
+			if end := strings.Index(string(glob[i+2:]), ":]"); end >= 0 {
+				name := string(glob[i+2:])[:end]
+				if !posixClasses[name] {
+					return "", 0, fmt.Errorf("invalid character class [:%s:]", name)
+				}
+				members.WriteString("[:" + name + ":]")
+				i += 2 + len([]rune(name)) + 1
+				continue
+			}
+		}
+		lo := c
+		if c == '\\' && i+1 < len(glob) {
+			i++
+			lo = glob[i]
+		}
+		if i+2 < len(glob) && glob[i+1] == '-' && glob[i+2] != ']' {
+			i += 2
+			hi := glob[i]
+			if hi == '\\' && i+1 < len(glob) {
+				i++
+				hi = glob[i]
+			}
+			if lo <= hi {
+				members.WriteString(classChar(lo) + "-" + classChar(hi))
+			}
+			continue
+		}
+		members.WriteString(classChar(lo))
+	}
+	return "", 0, nil
+}
+
+// classChar quotes r for use in a bracket expression
+func classChar(r rune) string {
+	if strings.ContainsRune(`\]-[^`, r) {
+		return `\` + string(r)
+	}
+	return string(r)
+}
+
+// ParseSize parses a size like 500, 10K, 1.5M or 2G, 1K being 1024 bytes.
+// An empty size gives 0.
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	unit := int64(1)
+	if n := len(number); n > 0 {
+		if i := strings.IndexByte("KMGT", number[n-1]); i >= 0 {
+			unit = int64(1) << (10 * uint(i+1))
+			number = number[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(unit)), nil
+}
+
+// ParseAge parses an age like 30s, 10m, 2h, 7d or 2w. An empty age gives 0.
+func ParseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(value * float64(unit)), nil
+		}
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return age, nil
+}
+
+// StartFilter prepares the filter for a scan of root, paths in patterns are
+// relative to it
+func StartFilter(root string) {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	filter.root = root
+	filter.now = time.Now()
+	filter.ignores = make(map[string][]*filterRule)
+	filter.readIgnores = nil
+	// -collision abort 会先扫描一次，计数只保留最后一次扫描的结果
+	for _, rule := range filter.flagRules() {
+		if rule != nil {
+			rule.files, rule.dirs = 0, 0
+		}
+	}
+}
+
+// flagRules returns the rules given by flags, the ones not given are nil
+func (f *Filter) flagRules() []*filterRule {
+	rules := append([]*filterRule{}, f.excludes...)
+	return append(rules, f.notIncluded, f.sizeRule, f.ageRule)
+}
+
+// Only restricts the upload to paths, given under the parent of the source
+// folder like in the run results. Used to retry the files that failed.
+func (f *Filter) Only(paths []string) {
+	f.only, f.onlyDirs = make(map[string]bool), make(map[string]bool)
+	for _, p := range paths {
+		p = filepath.ToSlash(p)
+		f.only[p] = true
+		for dir := pathDir(p); dir != ""; dir = pathDir(dir) {
+			f.onlyDirs[dir] = true
+		}
+	}
+}
+
+// Excluded reports whether the file or directory at p is left out of the
+// upload, a directory that is left out is not scanned at all
+func Excluded(p string, info os.FileInfo) bool {
+	return filter.excluded(p, info)
+}
+
+func (f *Filter) excluded(p string, info os.FileInfo) bool {
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	isDir := info.IsDir()
+	if f.only != nil {
+		full, err := filepath.Rel(filepath.Dir(f.root), p)
+		full = filepath.ToSlash(full)
+		if err != nil || isDir && !f.onlyDirs[full] || !isDir && !f.only[full] {
+			return true
+		}
+	}
+	for _, rule := range f.excludes {
+		if rule.match(rel, isDir) {
+			rule.count(isDir)
+			return true
+		}
+	}
+	if !isDir {
+		if f.notIncluded != nil && !f.included(rel) {
+			f.notIncluded.count(false)
+			return true
+		}
+		if f.sizeRule != nil && (info.Size() < f.minSize || f.maxSize > 0 && info.Size() > f.maxSize) {
+			f.sizeRule.count(false)
+			return true
+		}
+		// min-age 用来跳过刚写入、可能还没有下载完的文件
+		age := f.now.Sub(info.ModTime())
+		if f.ageRule != nil && (f.minAge > 0 && age < f.minAge || f.maxAge > 0 && age > f.maxAge) {
+			f.ageRule.count(false)
+			return true
+		}
+	}
+	// 从根目录到文件所在目录依次应用忽略文件，后面匹配的规则优先
+	var dirs []string
+	for dir := pathDir(rel); dir != ""; dir = pathDir(dir) {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, "")
+	var last *filterRule
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		for _, rule := range f.ignoreRules(dir) {
+			sub := rel
+			if dir != "" {
+				sub = rel[len(dir)+1:]
+			}
+			if rule.match(sub, isDir) {
+				last = rule
+			}
+		}
+	}
+	if last != nil && !last.negate {
+		last.count(isDir)
+		return true
+	}
+	return false
+}
+
+// included reports whether rel or one of its directories matches an -include
+func (f *Filter) included(rel string) bool {
+	for _, rule := range f.includes {
+		if rule.match(rel, false) {
+			return true
+		}
+		for dir := pathDir(rel); dir != ""; dir = pathDir(dir) {
+			if rule.match(dir, true) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathDir returns the directory of the slash separated path rel, "" for the root
+func pathDir(rel string) string {
+	if i := strings.LastIndexByte(rel, '/'); i >= 0 {
+		return rel[:i]
+	}
+	return ""
+}
+
+// ignoreRules returns the rules of the ignore file in the directory dir,
+// relative to the root, read once per scan
+func (f *Filter) ignoreRules(dir string) []*filterRule {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if rules, ok := f.ignores[dir]; ok {
+		return rules
+	}
+	var rules []*filterRule
+	name := filepath.Join(f.root, filepath.FromSlash(dir), IgnoreFileName)
+	if file, err := os.Open(name); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			source := filepath.ToSlash(filepath.Join(filepath.Base(f.root), dir, IgnoreFileName)) + ": " + strings.TrimSpace(scanner.Text())
+			rule, err := parseIgnoreLine(scanner.Text())
+			if err != nil {
+				// 无法解析的行跳过，其余规则仍然有效
+				log.Printf("%s: %v", source, err)
+				continue
+			}
+			if rule != nil {
+				rule.source = source
+				rules = append(rules, rule)
+			}
+		}
+		_ = file.Close()
+		f.readIgnores = append(f.readIgnores, rules...)
+	}
+	if f.ignores == nil {
+		f.ignores = make(map[string][]*filterRule)
+	}
+	f.ignores[dir] = rules
+	return rules
+}
+
+// FilterCount is how many files and directories a rule left out
+type FilterCount struct {
+	Rule  string
+	Files int64
+	Dirs  int64
+}
+
+// FilterReport returns the rules that left out files or directories in the
+// last scan, in the order they were given
+func FilterReport() []FilterCount {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	rules := append(filter.flagRules(), filter.readIgnores...)
+	var report []FilterCount
+	for _, rule := range rules {
+		if rule == nil {
+			continue
+		}
+		files, dirs := atomic.LoadInt64(&rule.files), atomic.LoadInt64(&rule.dirs)
+		if files > 0 || dirs > 0 {
+			report = append(report, FilterCount{Rule: rule.source, Files: files, Dirs: dirs})
+		}
+	}
+	return report
+}
@@ -0,0 +1,216 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		match []string
+		miss  []string
+	}{
+		{glob: "*.txt", match: []string{"a.txt", ".txt"}, miss: []string{"a/b.txt", "a.txt.bak"}},
+		{glob: "a?c", match: []string{"abc"}, miss: []string{"a/c", "ac"}},
+		{glob: "**/b", match: []string{"b", "a/b", "a/x/b"}, miss: []string{"ab"}},
+		{glob: "a/**", match: []string{"a/b", "a/b/c"}, miss: []string{"b/a"}},
+		{glob: `\*.txt`, match: []string{"*.txt"}, miss: []string{"a.txt"}},
+		{glob: "[abc].txt", match: []string{"a.txt", "c.txt"}, miss: []string{"d.txt"}},
+		{glob: "[!abc].txt", match: []string{"d.txt"}, miss: []string{"a.txt", "/.txt"}},
+		{glob: "[^a]", match: []string{"b"}, miss: []string{"a"}},
+		{glob: "[a-c]x", match: []string{"bx"}, miss: []string{"dx"}},
+		{glob: "[[:digit:]]*", match: []string{"1.log", "9"}, miss: []string{"a1"}},
+		{glob: "[[:alpha:][:digit:]]", match: []string{"a", "7"}, miss: []string{"-"}},
+		{glob: "[]a]", match: []string{"]", "a"}, miss: []string{"b"}},
+		{glob: "[!]]", match: []string{"a"}, miss: []string{"]"}},
+		{glob: "[a-]", match: []string{"a", "-"}, miss: []string{"b"}},
+		{glob: "[z-a]", miss: []string{"z", "a", "m"}},
+		{glob: "foo[]", match: []string{"foo[]"}, miss: []string{"foo"}},
+		{glob: "[!]", match: []string{"[!]"}, miss: []string{"a"}},
+		{glob: "a[b", match: []string{"a[b"}, miss: []string{"ab"}},
+		{glob: "[中文].txt", match: []string{"中.txt"}, miss: []string{"英.txt"}},
+	}
+	for _, test := range tests {
+		rule, err := parseIgnoreLine("/" + test.glob)
+		if err != nil {
+			t.Errorf("%q: %v", test.glob, err)
+			continue
+		}
+		for _, p := range test.match {
+			if !rule.re.MatchString(p) {
+				t.Errorf("%q does not match %q", test.glob, p)
+			}
+		}
+		for _, p := range test.miss {
+			if rule.re.MatchString(p) {
+				t.Errorf("%q matches %q", test.glob, p)
+			}
+		}
+	}
+}
+
+func TestGlobToRegexpInvalid(t *testing.T) {
+	for _, glob := range []string{"[[:nope:]]", "a[[:foo:]b]"} {
+		if _, err := globToRegexp(glob); err == nil {
+			t.Errorf("%q: no error", glob)
+		}
+	}
+}
+
+func TestParseIgnoreLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		empty   bool
+		negate  bool
+		dirOnly bool
+		match   []string
+		miss    []string
+	}{
+		{line: "", empty: true},
+		{line: "   ", empty: true},
+		{line: "# comment", empty: true},
+		{line: "/", empty: true},
+		{line: `\#file`, match: []string{"#file"}},
+		{line: `\!file`, match: []string{"!file"}},
+		{line: "!keep.txt", negate: true, match: []string{"keep.txt", "a/keep.txt"}},
+		{line: "cache/", dirOnly: true, match: []string{"cache", "a/cache"}},
+		{line: "/top.txt", match: []string{"top.txt"}, miss: []string{"a/top.txt"}},
+		{line: "a/b.txt", match: []string{"a/b.txt"}, miss: []string{"x/a/b.txt"}},
+		{line: "name.txt  ", match: []string{"name.txt"}},
+	}
+	for _, test := range tests {
+		rule, err := parseIgnoreLine(test.line)
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		if test.empty {
+			if rule != nil {
+				t.Errorf("%q: got a rule", test.line)
+			}
+			continue
+		}
+		if rule == nil {
+			t.Errorf("%q: no rule", test.line)
+			continue
+		}
+		if rule.negate != test.negate || rule.dirOnly != test.dirOnly {
+			t.Errorf("%q: negate %v dirOnly %v", test.line, rule.negate, rule.dirOnly)
+		}
+		for _, p := range test.match {
+			if !rule.re.MatchString(p) {
+				t.Errorf("%q does not match %q", test.line, p)
+			}
+		}
+		for _, p := range test.miss {
+			if rule.re.MatchString(p) {
+				t.Errorf("%q matches %q", test.line, p)
+			}
+		}
+	}
+	if _, err := parseIgnoreLine("[[:nope:]]"); err == nil {
+		t.Error("invalid class: no error")
+	}
+}
+
+func TestParseFilterRuleInvalid(t *testing.T) {
+	for _, pattern := range []string{"!a", "re:(", "[[:nope:]]"} {
+		if _, err := parseFilterRule(pattern, pattern); err == nil {
+			t.Errorf("%q: no error", pattern)
+		}
+	}
+	if _, err := parseFilterRule("[[:digit:]]*", ""); err != nil {
+		t.Errorf("[[:digit:]]*: %v", err)
+	}
+}
+
+// writeFile creates the file at p with its directories
+func writeFile(t *testing.T, p string, data string) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIgnoreNegationOrder(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "src")
+	writeFile(t, filepath.Join(root, IgnoreFileName), "*.log\n!keep.log\n[[:nope:]]\n[z-a]\n")
+	writeFile(t, filepath.Join(root, "sub", IgnoreFileName), "keep.log\n!other.log\n")
+	files := map[string]bool{
+		"a.log":         true,
+		"keep.log":      false,
+		"a.txt":         false,
+		"sub/a.log":     true,
+		"sub/keep.log":  true,
+		"sub/other.log": false,
+	}
+	for name := range files {
+		writeFile(t, filepath.Join(root, filepath.FromSlash(name)), "x")
+	}
+
+	f := &Filter{}
+	SetFilter(f)
+	defer SetFilter(&Filter{})
+	StartFilter(root)
+	for name, want := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Excluded(p, info); got != want {
+			t.Errorf("%s: excluded %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestAgeLimits(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "src")
+	now := time.Now()
+	files := map[string]time.Time{
+		"future.txt": now.Add(time.Hour),
+		"new.txt":    now.Add(-time.Minute),
+		"old.txt":    now.Add(-10 * 24 * time.Hour),
+	}
+	for name, modTime := range files {
+		p := filepath.Join(root, name)
+		writeFile(t, p, "x")
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		minAge, maxAge string
+		excluded       map[string]bool
+	}{
+		// 只有 -max-age 时修改时间在未来的文件不算太新
+		{maxAge: "7d", excluded: map[string]bool{"future.txt": false, "new.txt": false, "old.txt": true}},
+		{minAge: "1h", excluded: map[string]bool{"future.txt": true, "new.txt": true, "old.txt": false}},
+		{minAge: "1h", maxAge: "7d", excluded: map[string]bool{"future.txt": true, "new.txt": true, "old.txt": true}},
+	}
+	defer SetFilter(&Filter{})
+	for _, test := range tests {
+		f, err := NewFilter(nil, nil, "", "", test.minAge, test.maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetFilter(f)
+		StartFilter(root)
+		for name, want := range test.excluded {
+			p := filepath.Join(root, name)
+			info, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Excluded(p, info); got != want {
+				t.Errorf("-min-age %q -max-age %q %s: excluded %v, want %v", test.minAge, test.maxAge, name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fileutil
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// quickXorHash is the hash OneDrive computes for every file, see
+// https://docs.microsoft.com/onedrive/developer/code-snippets/quickxorhash
+type quickXorHash struct {
+	data        [3]uint64
+	shiftSoFar  int
+	lengthSoFar int64
+}
+
+const (
+	quickXorWidth = 160
+	quickXorShift = 11
+)
+
+// NewQuickXorHash returns a hash.Hash computing the OneDrive quickXorHash
+func NewQuickXorHash() hash.Hash {
+	return &quickXorHash{}
+}
+
+func (q *quickXorHash) Write(p []byte) (int, error) {
+	vectorArrayIndex := q.shiftSoFar / 64
+	vectorOffset := q.shiftSoFar % 64
+	iterations := len(p)
+	if iterations > quickXorWidth {
+		iterations = quickXorWidth
+	}
+	for i := 0; i < iterations; i++ {
+		isLastCell := vectorArrayIndex == len(q.data)-1
+		bitsInVectorCell := 64
+		if isLastCell {
+			bitsInVectorCell = quickXorWidth % 64
+		}
+		if vectorOffset <= bitsInVectorCell-8 {
+			for j := i; j < len(p); j += quickXorWidth {
+				q.data[vectorArrayIndex] ^= uint64(p[j]) << uint(vectorOffset)
+			}
+		} else {
+			// 跨越两个单元的字节，分成高低两部分分别异或
+			index2 := vectorArrayIndex + 1
+			if isLastCell {
+				index2 = 0
+			}
+			low := uint(bitsInVectorCell - vectorOffset)
+			var xoredByte byte
+			for j := i; j < len(p); j += quickXorWidth {
+				xoredByte ^= p[j]
+			}
+			q.data[vectorArrayIndex] ^= uint64(xoredByte) << uint(vectorOffset)
+			q.data[index2] ^= uint64(xoredByte) >> low
+		}
+		vectorOffset += quickXorShift
+		if vectorOffset >= bitsInVectorCell {
+			if isLastCell {
+				vectorArrayIndex = 0
+			} else {
+				vectorArrayIndex++
+			}
+			vectorOffset -= bitsInVectorCell
+		}
+	}
+	q.shiftSoFar = (q.shiftSoFar + quickXorShift*(len(p)%quickXorWidth)) % quickXorWidth
+	q.lengthSoFar += int64(len(p))
+	return len(p), nil
+}
+
+func (q *quickXorHash) Sum(b []byte) []byte {
+	rgb := make([]byte, quickXorWidth/8)
+	binary.LittleEndian.PutUint64(rgb[0:], q.data[0])
+	binary.LittleEndian.PutUint64(rgb[8:], q.data[1])
+	binary.LittleEndian.PutUint32(rgb[16:], uint32(q.data[2]))
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(q.lengthSoFar))
+	for i, c := range length {
+		rgb[len(rgb)-8+i] ^= c
+	}
+	return append(b, rgb...)
+}
+
+func (q *quickXorHash) Reset() {
+	*q = quickXorHash{}
+}
+
+func (q *quickXorHash) Size() int {
+	return quickXorWidth / 8
+}
+
+func (q *quickXorHash) BlockSize() int {
+	return 64
+}
+
+// HashFile returns the hash of the file at path in the format the drives
+// report it: quickXorHash in base64, sha1Hash and sha256Hash in upper case hex
+// (OneDrive) and md5Checksum in lower case hex (Google Drive)
+func HashFile(path string, hashType string) (string, error) {
+	var h hash.Hash
+	switch hashType {
+	case "quickXorHash":
+		h = NewQuickXorHash()
+	case "sha1Hash":
+		h = sha1.New()
+	case "sha256Hash":
+		h = sha256.New()
+	case "md5Checksum":
+		h = md5.New()
+	default:
+		return "", fmt.Errorf("unsupported hash type %q", hashType)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	switch hashType {
+	case "quickXorHash":
+		return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+	case "md5Checksum":
+		return hex.EncodeToString(h.Sum(nil)), nil
+	default:
+		return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+	}
+}
+
+// SameHash compares two hashes of hashType, hex digests are case insensitive
+func SameHash(hashType string, a string, b string) bool {
+	if hashType == "quickXorHash" {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
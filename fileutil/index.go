@@ -0,0 +1,180 @@
+package fileutil
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// IndexEntry records a file that has been uploaded completely
+// 记录一个已经完整上传的文件，下次运行时大小和修改时间都没有变化的文件会被跳过
+type IndexEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"modTime"`
+	HashType string `json:"hashType,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+	ItemID   string `json:"itemId"`
+	Backend  string `json:"backend"`
+	Account  string `json:"account"`
+}
+
+func (e IndexEntry) key() string {
+	return e.Backend + "\x00" + e.Account + "\x00" + e.Path
+}
+
+// Index is the local upload index, one JSON entry per line. Entries are
+// appended as files complete, a later entry for the same file wins.
+type Index struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+	lines int
+	items map[string]IndexEntry
+}
+
+// LoadIndex reads the index at path and opens it for appending. A missing
+// file gives an empty index, broken lines are ignored.
+func LoadIndex(path string) (*Index, error) {
+	index := &Index{path: path, items: make(map[string]IndexEntry)}
+	if f, err := os.Open(path); err == nil {
+		index.read(f)
+		_ = f.Close()
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index.file = f
+	return index, nil
+}
+
+// ReadIndex reads the index at path without opening it for writing, entries
+// added later are only kept in memory. Used by the dry run.
+func ReadIndex(path string) *Index {
+	index := &Index{path: path, items: make(map[string]IndexEntry)}
+	if f, err := os.Open(path); err == nil {
+		index.read(f)
+		_ = f.Close()
+	}
+	return index
+}
+
+func (x *Index) read(f *os.File) {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry IndexEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		x.items[entry.key()] = entry
+		x.lines++
+	}
+}
+
+// Path returns the file the index is saved to
+func (x *Index) Path() string {
+	return x.path
+}
+
+// Unchanged reports whether the file at remotePath was uploaded with the same
+// size and modification time
+func (x *Index) Unchanged(backend string, account string, remotePath string, size int64, modTime int64) bool {
+	if x == nil {
+		return false
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	entry, ok := x.items[IndexEntry{Backend: backend, Account: account, Path: remotePath}.key()]
+	return ok && entry.Size == size && entry.ModTime == modTime
+}
+
+// Entry returns the recorded upload of the file at remotePath
+func (x *Index) Entry(backend string, account string, remotePath string) (IndexEntry, bool) {
+	if x == nil {
+		return IndexEntry{}, false
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	entry, ok := x.items[IndexEntry{Backend: backend, Account: account, Path: remotePath}.key()]
+	return entry, ok
+}
+
+// Add records entry and appends it to the index file right away, so the
+// progress survives a crash
+func (x *Index) Add(entry IndexEntry) error {
+	if x == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.items[entry.key()] = entry
+	x.lines++
+	if x.file == nil {
+		return nil
+	}
+	_, err = x.file.Write(append(data, '\n'))
+	return err
+}
+
+// Reset forgets every entry of backend and account, used before the index is
+// rebuilt from the drive
+func (x *Index) Reset(backend string, account string) {
+	if x == nil {
+		return
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for k, entry := range x.items {
+		if entry.Backend == backend && entry.Account == account {
+			delete(x.items, k)
+		}
+	}
+	// 强制在 Close 时重写文件
+	x.lines = -1
+}
+
+// Close closes the index file. When it holds many superseded entries it is
+// rewritten with only the latest entry of every file.
+func (x *Index) Close() error {
+	if x == nil || x.file == nil {
+		return nil
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if err := x.file.Close(); err != nil {
+		return err
+	}
+	if x.lines >= 0 && x.lines <= 2*len(x.items) {
+		return nil
+	}
+	tmp := x.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, entry := range x.items {
+		if err = encoder.Encode(entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, x.path)
+}
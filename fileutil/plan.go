@@ -0,0 +1,70 @@
+package fileutil
+
+import (
+	"sort"
+	"sync"
+)
+
+// PlannedFile is what the upload would do with one file: upload, skip,
+// replace or rename. Reason tells why a file is skipped.
+type PlannedFile struct {
+	Path       string `json:"path"`
+	RemotePath string `json:"remotePath"`
+	Action     string `json:"action"`
+	Reason     string `json:"reason,omitempty"`
+	Size       int64  `json:"size"`
+}
+
+// Plan collects the planned actions of a dry run
+type Plan struct {
+	mutex   sync.Mutex
+	files   []PlannedFile
+	folders []string
+}
+
+// plan 不为空时只扫描和检查网盘，不上传也不修改任何东西
+var plan *Plan
+
+// SetPlan turns the dry run on, the planned actions are collected in p
+func SetPlan(p *Plan) {
+	plan = p
+}
+
+// DryRun reports whether the upload only collects its plan
+func DryRun() bool {
+	return plan != nil
+}
+
+// PlanFile records the planned action for a file
+func PlanFile(file PlannedFile) {
+	plan.mutex.Lock()
+	defer plan.mutex.Unlock()
+	plan.files = append(plan.files, file)
+}
+
+// PlanFolder records a remote folder the upload would create
+func PlanFolder(remotePath string) {
+	plan.mutex.Lock()
+	defer plan.mutex.Unlock()
+	plan.folders = append(plan.folders, remotePath)
+}
+
+// Files returns the planned files sorted by path
+func (p *Plan) Files() []PlannedFile {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	files := append([]PlannedFile(nil), p.files...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+// Folders returns the remote folders to create, sorted
+func (p *Plan) Folders() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	folders := append([]string(nil), p.folders...)
+	sort.Strings(folders)
+	return folders
+}
@@ -0,0 +1,62 @@
+package fileutil
+
+import (
+	"main/notify"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileResult is how the upload of one file ended: uploaded, skipped, failed
+// or unfinished when the run was interrupted. Path is the local path under
+// the parent of the source folder, Reason tells why a file was skipped or
+// failed and Error holds the message of a failed upload.
+type FileResult struct {
+	Path       string `json:"path"`
+	RemotePath string `json:"remotePath"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Size       int64  `json:"size"`
+	ItemID     string `json:"itemId,omitempty"`
+	WebURL     string `json:"webUrl,omitempty"`
+	// Elapsed 是上传用去的时间，只用于显示
+	Elapsed time.Duration `json:"-"`
+}
+
+// Results collects the results of the files of one run
+type Results struct {
+	mutex sync.Mutex
+	files []FileResult
+}
+
+var results = &Results{}
+
+// RecordResult records how the upload of a file ended and publishes it as
+// FileDone or FileFailed
+func RecordResult(result FileResult) {
+	results.mutex.Lock()
+	results.files = append(results.files, result)
+	results.mutex.Unlock()
+	if result.Status == "uploaded" || result.Status == "skipped" {
+		notify.Publish(notify.FileDone{Path: result.Path, RemotePath: result.RemotePath, Size: result.Size, Status: result.Status, Reason: result.Reason, ItemID: result.ItemID, Elapsed: result.Elapsed})
+	} else {
+		notify.Publish(result.Failure())
+	}
+}
+
+// Failure returns the failed result as a FileFailed event
+func (r FileResult) Failure() notify.FileFailed {
+	return notify.FileFailed{Path: r.Path, RemotePath: r.RemotePath, Size: r.Size, Status: r.Status, Reason: r.Reason, Err: r.Error}
+}
+
+// RunResults returns the results of the run sorted by path
+func RunResults() []FileResult {
+	results.mutex.Lock()
+	defer results.mutex.Unlock()
+	files := append([]FileResult(nil), results.files...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
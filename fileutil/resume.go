@@ -0,0 +1,93 @@
+package fileutil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ResumeItem records an unfinished upload session of a large file
+// 记录一个未完成的大文件上传会话，下次运行时可以从断点继续
+type ResumeItem struct {
+	UploadURL string `json:"uploadUrl"`
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"modTime"`
+}
+
+// ResumeState is the set of unfinished upload sessions, keyed by remote path
+type ResumeState struct {
+	path  string
+	mutex sync.Mutex
+	items map[string]ResumeItem
+}
+
+// LoadResumeState reads the resume state saved by an interrupted run. A missing
+// or broken file gives an empty state.
+func LoadResumeState(path string) *ResumeState {
+	state := &ResumeState{path: path, items: make(map[string]ResumeItem)}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		_ = json.Unmarshal(data, &state.items)
+	}
+	return state
+}
+
+// Path returns the file the state is saved to
+func (s *ResumeState) Path() string {
+	return s.path
+}
+
+// Get returns the saved session for key if the local file has not changed since
+func (s *ResumeState) Get(key string, size int64, modTime int64) (ResumeItem, bool) {
+	if s == nil {
+		return ResumeItem{}, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item, ok := s.items[key]
+	if !ok || item.Size != size || item.ModTime != modTime {
+		return ResumeItem{}, false
+	}
+	return item, true
+}
+
+func (s *ResumeState) Put(key string, item ResumeItem) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.items[key] = item
+	s.mutex.Unlock()
+}
+
+func (s *ResumeState) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	delete(s.items, key)
+	s.mutex.Unlock()
+}
+
+// Save writes the state to disk, the file is removed when nothing is left to resume
+func (s *ResumeState) Save() error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.items) == 0 {
+		err := os.Remove(s.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(s.items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, 0644)
+}
@@ -0,0 +1,211 @@
+package fileutil
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// OneDrive 的文件名限制，见
+// https://support.microsoft.com/office/restrictions-and-limitations-in-onedrive-and-sharepoint-64883a5d-228e-48f5-b3d2-eb39e07630fa
+const (
+	maxNameLength = 255
+	maxPathLength = 400
+)
+
+// 不能出现在文件名中的字符替换为对应的全角字符，看起来几乎一样，并且可以还原
+var illegalChars = strings.NewReplacer(
+	`"`, "＂", "*", "＊", ":", "：", "<", "＜", ">", "＞",
+	"?", "？", "/", "／", `\`, "＼", "|", "｜",
+)
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true,
+	"COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true,
+	"LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	".LOCK": true, "DESKTOP.INI": true,
+}
+
+var sanitize bool
+var nameMapping *NameMapping
+
+// SetSanitize turns the sanitization of remote names on or off, the changed
+// names are recorded in mapping when it is not nil
+func SetSanitize(enable bool, mapping *NameMapping) {
+	sanitize = enable
+	nameMapping = mapping
+}
+
+// RemotePath returns the slash separated remote path of the local path p.
+// With sanitization on, every part of the path is made acceptable to OneDrive
+// and the original path is recorded in the name mapping.
+func RemotePath(p string) string {
+	if remote, ok := remoteOverride(p); ok {
+		return remote
+	}
+	if !sanitize {
+		return strings.ReplaceAll(p, `\`, "/")
+	}
+	// 只有 Windows 下的 \ 是路径分隔符，其他系统中它是文件名的一部分
+	p = filepath.ToSlash(p)
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if part != "" && part != "." {
+			parts[i] = SanitizeName(part)
+		}
+	}
+	remote := strings.Join(parts, "/")
+	// 路径过长时缩短文件名，文件夹名保持不变，保证同一文件夹下的文件仍在同一文件夹中
+	if n := utf8.RuneCountInString(remote); n > maxPathLength {
+		last := len(parts) - 1
+		keep := utf8.RuneCountInString(parts[last]) - (n - maxPathLength)
+		parts[last] = shortenName(parts[last], keep)
+		remote = strings.Join(parts, "/")
+	}
+	if remote != p {
+		if err := nameMapping.Record(remote, p); err != nil {
+			// 记录失败不影响上传
+			log.Println(err)
+		}
+	}
+	return remote
+}
+
+// SanitizeName returns name with the characters and names OneDrive rejects
+// replaced by full width look-alikes, and shortened to the name length limit
+func SanitizeName(name string) string {
+	name = illegalChars.Replace(name)
+	// 开头和结尾的空格、结尾的点会被 OneDrive 拒绝或去掉
+	if strings.HasPrefix(name, " ") {
+		name = "␠" + name[1:]
+	}
+	if strings.HasSuffix(name, " ") {
+		name = name[:len(name)-1] + "␠"
+	}
+	if strings.HasSuffix(name, ".") {
+		name = name[:len(name)-1] + "．"
+	}
+	base := strings.ToUpper(name)
+	if !strings.HasPrefix(base, ".") {
+		base = strings.SplitN(base, ".", 2)[0]
+	}
+	if reservedNames[base] || reservedNames[strings.ToUpper(name)] || strings.HasPrefix(name, "~$") {
+		name = fullWidth(name[:1]) + name[1:]
+	}
+	name = strings.ReplaceAll(name, "_vti_", "＿vti_")
+	if utf8.RuneCountInString(name) > maxNameLength {
+		name = shortenName(name, maxNameLength)
+	}
+	return name
+}
+
+// fullWidth converts printable ASCII to the full width forms
+func fullWidth(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r > 0x20 && r < 0x7f {
+			r += 0xfee0
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// shortenName cuts name to at most max characters, keeping the extension and
+// adding a short hash of the full name so shortened names stay unique
+func shortenName(name string, max int) string {
+	sum := sha1.Sum([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+	ext := path.Ext(name)
+	if utf8.RuneCountInString(ext) > 16 {
+		ext = ""
+	}
+	stem := []rune(strings.TrimSuffix(name, ext))
+	keep := max - utf8.RuneCountInString(suffix+ext)
+	if keep < 1 {
+		keep = 1
+	}
+	if keep < len(stem) {
+		stem = stem[:keep]
+	}
+	return string(stem) + suffix + ext
+}
+
+// NameMapping records the remote names that differ from the local ones, one
+// JSON object per line, so the original names can be restored on download
+type NameMapping struct {
+	mutex sync.Mutex
+	file  *os.File
+	seen  map[string]bool
+	// value 是每行中与 remote 对应的字段名
+	value string
+}
+
+// LoadNameMapping opens the mapping file at path for appending, names recorded
+// by earlier runs are not written again
+func LoadNameMapping(path string) (*NameMapping, error) {
+	return loadMapping(path, "local")
+}
+
+// LoadLinkRecord opens the file at path recording the targets of the symlinks
+// left out by -symlinks record, so the links can be created again on download
+func LoadLinkRecord(path string) (*NameMapping, error) {
+	return loadMapping(path, "target")
+}
+
+func loadMapping(path string, value string) (*NameMapping, error) {
+	m := &NameMapping{seen: make(map[string]bool), value: value}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry map[string]string
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+				m.seen[entry["remote"]] = true
+			}
+		}
+		_ = f.Close()
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m.file = f
+	return m, nil
+}
+
+// Record appends that remote is the sanitized name of local, or the remote
+// path of a link to local for a link record
+func (m *NameMapping) Record(remote string, local string) error {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.seen[remote] {
+		return nil
+	}
+	m.seen[remote] = true
+	data, err := json.Marshal(map[string]string{"remote": remote, m.value: local})
+	if err != nil {
+		return err
+	}
+	_, err = m.file.Write(append(data, '\n'))
+	return err
+}
+
+func (m *NameMapping) Close() error {
+	if m == nil {
+		return nil
+	}
+	return m.file.Close()
+}
@@ -0,0 +1,86 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrVanished is returned for a file that was deleted after the scan
+var ErrVanished = errors.New("file vanished")
+
+// ErrChanged is returned for a file that is still being written
+var ErrChanged = errors.New("file changed during upload")
+
+// 文件变化后每隔 stableWait 检查一次，连续两次大小和修改时间相同才认为已经写完
+var stableWait = 2 * time.Second
+var stableChecks = 30
+
+// IsSpecial reports whether mode is a socket, FIFO or device, which can't be
+// uploaded and would block when opened
+func IsSpecial(mode os.FileMode) bool {
+	return mode&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0
+}
+
+func sizeType(size int64) string {
+	if size > maxFileSizeInBytes {
+		return SizeTypeLarge
+	}
+	return SizeTypeSmall
+}
+
+// Changed stats the file again and reports whether its size or modification
+// time differ from those recorded at the scan. A deleted file gives ErrVanished.
+func (f FileInfo) Changed() (os.FileInfo, bool, error) {
+	stat, err := os.Stat(f.Path)
+	if os.IsNotExist(err) {
+		return nil, false, ErrVanished
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return stat, stat.Size() != f.Size || !stat.ModTime().Equal(f.ModTime), nil
+}
+
+// WaitStable waits until the file stops changing and records its current size
+// and modification time in f. It gives ErrChanged when the file is still
+// changing after all the checks.
+func WaitStable(f *FileInfo) error {
+	for i := 0; ; i++ {
+		stat, changed, err := f.Changed()
+		if err != nil {
+			return err
+		}
+		if !changed {
+			break
+		}
+		if i == stableChecks {
+			return ErrChanged
+		}
+		f.Size, f.ModTime = stat.Size(), stat.ModTime()
+		time.Sleep(stableWait)
+	}
+	f.SizeType = sizeType(f.Size)
+	return nil
+}
+
+// Open opens the file for its upload, a deleted file gives ErrVanished
+func (f *FileInfo) Open() error {
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		return ErrVanished
+	}
+	if err != nil {
+		return err
+	}
+	f.FileData = file
+	return nil
+}
+
+// Close closes the file opened by Open
+func (f *FileInfo) Close() {
+	if f.FileData != nil {
+		_ = f.FileData.Close()
+		f.FileData = nil
+	}
+}
@@ -0,0 +1,165 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// symlinks 是 -symlinks 选择的符号链接处理方式：files、skip、follow 或 record
+var symlinks = "files"
+var reportLink func(p string, target string, action string)
+
+// reportUnreadable 收到扫描时无法读取的文件夹和文件
+var reportUnreadable func(p string, err error)
+
+// SetSymlinks sets how scans handle symlinks: files uploads what links to
+// files point to and leaves out links to folders, skip leaves them out,
+// follow uploads what they point to and record leaves them out but reports them so
+// their targets can be saved. report is told about every link that is not
+// followed, with action skip, record, broken or loop.
+func SetSymlinks(mode string, report func(p string, target string, action string)) {
+	symlinks = mode
+	reportLink = report
+}
+
+// SetUnreadable sets report to be told about every folder or file below the
+// source that can't be read, the scan leaves them out and goes on. Without it
+// the scan stops at the first of them.
+func SetUnreadable(report func(p string, err error)) {
+	reportUnreadable = report
+}
+
+// ResolveSymlink returns the info of what the symlink at p points to, or nil
+// when the link is not followed. ancestors are the directories containing p,
+// a link to one of them would make the scan loop.
+func ResolveSymlink(p string, ancestors []os.FileInfo) os.FileInfo {
+	target, _ := os.Readlink(p)
+	report := func(action string) os.FileInfo {
+		if reportLink != nil {
+			reportLink(p, target, action)
+		}
+		return nil
+	}
+	if symlinks == "skip" || symlinks == "record" {
+		return report(symlinks)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return report("broken")
+	}
+	if info.IsDir() {
+		// 默认和以前的扫描一样，不进入链接指向的文件夹
+		if symlinks != "follow" {
+			return report("skip")
+		}
+		for _, ancestor := range ancestors {
+			if os.SameFile(ancestor, info) {
+				return report("loop")
+			}
+		}
+	}
+	return info
+}
+
+// WalkSource walks sourcePath in lexical order like filepath.Walk, but
+// handles symlinks as set by SetSymlinks and leaves out what the filter
+// excludes as well as sockets, FIFOs and devices. onDir is called for every
+// directory before the files in it, onFile for every file. sourcePath itself
+// is always followed when it is a symlink.
+func WalkSource(sourcePath string, onDir func(dir string) error, onFile func(p string, info os.FileInfo) error) error {
+	StartFilter(sourcePath)
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	w := walker{root: sourcePath, onDir: onDir, onFile: onFile}
+	return w.walk(sourcePath, info, SourceAncestors(sourcePath))
+}
+
+// SourceAncestors returns the directories containing sourcePath, a link to
+// one of them would upload the source again
+func SourceAncestors(sourcePath string) []os.FileInfo {
+	var ancestors []os.FileInfo
+	real, err := filepath.EvalSymlinks(sourcePath)
+	if err != nil {
+		return nil
+	}
+	real, err = filepath.Abs(real)
+	if err != nil {
+		return nil
+	}
+	for dir := filepath.Dir(real); ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(dir); err == nil {
+			ancestors = append(ancestors, info)
+		}
+		if dir == filepath.Dir(dir) {
+			return ancestors
+		}
+	}
+}
+
+type walker struct {
+	root   string
+	onDir  func(dir string) error
+	onFile func(p string, info os.FileInfo) error
+}
+
+func (w walker) walk(p string, info os.FileInfo, ancestors []os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		if info = ResolveSymlink(p, ancestors); info == nil {
+			return nil
+		}
+	}
+	if Excluded(p, info) {
+		// 被排除的文件夹整个跳过，不再扫描其中的文件
+		return nil
+	}
+	if !info.IsDir() {
+		if IsSpecial(info.Mode()) {
+			// socket、FIFO 和设备文件无法上传，打开 FIFO 还会一直阻塞
+			return nil
+		}
+		return w.onFile(p, info)
+	}
+	if w.onDir != nil {
+		if err := w.onDir(p); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(p)
+	if os.IsNotExist(err) {
+		// 扫描过程中被删除的文件夹直接忽略
+		return nil
+	}
+	if err != nil {
+		return w.unreadable(p, err)
+	}
+	ancestors = append(ancestors, info)
+	for _, entry := range entries {
+		child := filepath.Join(p, entry.Name())
+		childInfo, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			if err := w.unreadable(child, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.walk(child, childInfo, ancestors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unreadable reports the folder or file p the scan can't read and leaves it
+// out, only an unreadable source stops the scan
+func (w walker) unreadable(p string, err error) error {
+	if p == w.root || reportUnreadable == nil {
+		return err
+	}
+	reportUnreadable(p, err)
+	return nil
+}
@@ -0,0 +1,89 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSymlink(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "dir", "a.txt"), "x")
+	if err := os.Symlink(filepath.Join(root, "dir", "a.txt"), filepath.Join(root, "file.lnk")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "dir"), filepath.Join(root, "dir.lnk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "broken.lnk")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mode     string
+		link     string
+		followed bool
+		action   string
+	}{
+		{mode: "files", link: "file.lnk", followed: true},
+		{mode: "files", link: "dir.lnk", action: "skip"},
+		{mode: "files", link: "broken.lnk", action: "broken"},
+		{mode: "follow", link: "file.lnk", followed: true},
+		{mode: "follow", link: "dir.lnk", followed: true},
+		{mode: "skip", link: "file.lnk", action: "skip"},
+		{mode: "record", link: "dir.lnk", action: "record"},
+	}
+	defer SetSymlinks("files", nil)
+	for _, test := range tests {
+		action := ""
+		SetSymlinks(test.mode, func(p string, target string, a string) {
+			action = a
+		})
+		info := ResolveSymlink(filepath.Join(root, test.link), nil)
+		if (info != nil) != test.followed || action != test.action {
+			t.Errorf("%s %s: followed %v action %q", test.mode, test.link, info != nil, action)
+		}
+	}
+}
+
+func TestWalkSourceUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not checked for root")
+	}
+	root := filepath.Join(t.TempDir(), "src")
+	writeFile(t, filepath.Join(root, "a.txt"), "x")
+	writeFile(t, filepath.Join(root, "locked", "b.txt"), "x")
+	writeFile(t, filepath.Join(root, "z.txt"), "x")
+	locked := filepath.Join(root, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+
+	var unreadable, files []string
+	SetUnreadable(func(p string, err error) {
+		unreadable = append(unreadable, p)
+	})
+	defer SetUnreadable(nil)
+	err := WalkSource(root, nil, func(p string, info os.FileInfo) error {
+		files = append(files, filepath.Base(p))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unreadable) != 1 || unreadable[0] != locked {
+		t.Errorf("unreadable %v", unreadable)
+	}
+	if len(files) != 2 || files[0] != "a.txt" || files[1] != "z.txt" {
+		t.Errorf("files %v", files)
+	}
+
+	// 上传的文件夹本身无法读取时扫描失败
+	if err := os.Chmod(root, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(root, 0755)
+	if err := WalkSource(root, nil, func(p string, info os.FileInfo) error { return nil }); err == nil {
+		t.Error("unreadable source: no error")
+	}
+}
@@ -3,17 +3,19 @@ package googledrive
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"main/fileutil"
 	httpLocal "main/graph/net/http"
+	"main/notify"
 	"math"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -37,11 +39,46 @@ var wg sync.WaitGroup
 var threads = 3
 var pool = make(chan struct{}, threads)
 
+// completed 和 unfinished 统计完成和因中断未上传的文件数量
+var completed int64
+var unfinished int64
+
+// index 记录已经上传的文件，rootDir 是计算网盘路径的本地起点，account 为配置文件名
+var index *fileutil.Index
+var rescanRemote bool
+var rootDir string
+var account string
+
+// stats 统计扫描到的文件数量和总大小
+var stats *fileutil.ScanStats
+
+// ancestors 是正在上传的文件夹及其上级文件夹
+var ancestors []os.FileInfo
+
+// maxRequeue 是上传过程中发生变化的文件最多重新上传的次数
+const maxRequeue = 3
+
 func changeThread(thread int) {
 	threads = thread
 	pool = make(chan struct{}, threads)
 }
 
+// transport 是 Google Drive 请求使用的连接池，包含代理、CA 证书和出口地址等设置
+var transport *http.Transport
+
+// SetTransport sets the transport used by all Google Drive requests
+func SetTransport(t *http.Transport) {
+	transport = t
+}
+
+// oauthContext 返回携带配置好的 client 的 context，token 请求同样经过代理等设置
+func oauthContext(ctx context.Context) context.Context {
+	if transport == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+}
+
 // getClient uses a Context and Config to retrieve a Token
 // then generate a Client. It returns the generated Client.
 func getClient(file string, ctx context.Context, config *oauth2.Config) *http.Client {
@@ -123,20 +160,19 @@ func tokenFromFile(c *oauth2.Config, file string, Thread int, BlockSize int, Lan
 	f, err = os.OpenFile(file, os.O_WRONLY|os.O_TRUNC, 0666)
 	defer f.Close()
 	// log.Printf("%+v\n", t)
-	updatedToken, err := c.TokenSource(context.TODO(), t).Token()
+	updatedToken, err := c.TokenSource(oauthContext(context.TODO()), t).Token()
 	// log.Printf("%+v\n", updatedToken)
-	data := httpLocal.Certificate{
-		Drive:        "GoogleDrive",
-		RefreshToken: ts.RefreshToken,
-		ThreadNum:    Thread,
-		BlockSize:    BlockSize,
-		MainLand:     false,
-		Language:     Language,
-		TimeOut:      TimeOut,
-		BotKey:       BotKey,
-		UserID:       UserID,
-		Other:        updatedToken,
-	}
+	// 只更新命令行相关的字段，保留配置文件中的其他设置
+	data := *ts
+	data.Drive = "GoogleDrive"
+	data.MainLand = false
+	data.ThreadNum = Thread
+	data.BlockSize = BlockSize
+	data.Language = Language
+	data.TimeOut = TimeOut
+	data.BotKey = BotKey
+	data.UserID = UserID
+	data.Other = updatedToken
 	err = json.NewEncoder(f).Encode(data)
 	if err != nil {
 		log.Fatalf("Unable to cache oauth token: %v", err)
@@ -171,78 +207,74 @@ func saveToken(file string, token *oauth2.Token, lang string) {
 	json.NewEncoder(f).Encode(data)
 }
 
-func byte2Readable(bytes float64) string {
-	const kb float64 = 1024
-	const mb float64 = kb * 1024
-	const gb float64 = mb * 1024
-	var readable float64
-	var unit string
-	_bytes := bytes
-
-	if _bytes >= gb {
-		// xx GB
-		readable = _bytes / gb
-		unit = "GB"
-	} else if _bytes < gb && _bytes >= mb {
-		// xx MB
-		readable = _bytes / mb
-		unit = "MB"
-	} else {
-		// xx KB
-		readable = _bytes / kb
-		unit = "KB"
-	}
-	return strconv.FormatFloat(readable, 'f', 2, 64) + " " + unit
-}
-
-func UploadAllFile(pathname string, folderIDList []string, srv *drive.Service, startTime int64, username string, sendMsg func() (func(text string), string, string, func(string, string, string) func(string)), locText func(text string) string) (func(string), error) {
+func UploadAllFile(ctx context.Context, pathname string, folderIDList []string, srv *drive.Service, locText func(text string) string) error {
 
-	filePath := path.Base(pathname)
-	temps, _botKey, iUserID, BotSend := sendMsg()
-	var iSendMsg func(string)
-	tip := "`" + filePath + "`" + locText("startUploadGoogleDrive")
-	if _botKey != "" && iUserID != "" {
-		iSendMsg = BotSend(_botKey, iUserID, tip)
-	}
-	temp := func(text string) {
-		temps(text)
-		if _botKey != "" && iUserID != "" {
-			iSendMsg(text)
+	rd, err := ioutil.ReadDir(pathname)
+	if info, statErr := os.Stat(pathname); err != nil && statErr == nil && info.IsDir() {
+		// 无法读取的子文件夹记为失败，扫描继续，只有上传的文件夹本身无法读取时才退出
+		if folderIDList == nil {
+			log.Fatalf(locText("readDirFail"), err)
 		}
+		recordFailure(pathname, 0, "read", err)
+		return nil
 	}
-	temp(tip)
-
-	rd, err := ioutil.ReadDir(pathname)
 	if err != nil {
 		_, fullName := filepath.Split(pathname)
 		var tempFolderIDList []string
 		if folderIDList == nil {
 			tempFolderIDList = folderIDList
 		}
-		f, err := os.Open(fullName)
+		fi, err := os.Stat(fullName)
 		if err != nil {
-			log.Fatalf("error opening %q: %v", fullName, err)
+			log.Fatalf(locText("openFileFail"), fullName, err)
 		}
-		defer f.Close()
+		stats.Add(fi.Size())
 		//log.Println("file", fi.Name(), fullName)
 		//上傳檔案，create要給定檔案名稱，要傳進資料夾就加上Parents參數給定folderID的array，media傳入我們要上傳的檔案，最後Do
 
-		uploadFile(srv, pathname, fullName, tempFolderIDList, f, sendMsg, locText, username)
-		// sendMsg(fmt.Sprintf(locText("googleDriveUploadTip"), username, fullName, time.Now().Unix()-startTime))
+		uploadFile(ctx, srv, pathname, fullName, tempFolderIDList, fileutil.FileInfo{Path: fullName, Size: fi.Size(), ModTime: fi.ModTime()})
+		wg.Wait()
+		return nil
+	}
+	// 记录正在上传的文件夹，指向其中之一的符号链接会导致无限循环
+	if info, err := os.Stat(pathname); err == nil {
+		ancestors = append(ancestors, info)
+		defer func() {
+			ancestors = ancestors[:len(ancestors)-1]
+		}()
 	}
 	_, foldName := filepath.Split(pathname)
 	//log.Println(foldName)
+	// 已存在的同名文件夹直接使用，这样再次上传时索引中的文件路径仍然有效
 	var createFolder *drive.File
-	if folderIDList == nil {
-		createFolder, err = srv.Files.Create(&drive.File{Name: foldName, MimeType: "application/vnd.google-apps.folder"}).Do()
+	if fileutil.DryRun() {
+		createFolder, err = planFolder(srv, pathname, foldName, folderIDList)
 	} else {
-		createFolder, err = srv.Files.Create(&drive.File{Name: foldName, Parents: folderIDList, MimeType: "application/vnd.google-apps.folder"}).Do()
+		createFolder, err = findOrCreateFolder(srv, foldName, folderIDList)
 	}
 	if err != nil {
-		log.Panicf("Unable to create folder: %v", err)
+		log.Panicf(locText("googleDriveFolderFail"), err)
 	}
 
 	for _, fi := range rd {
+		if ctx.Err() != nil {
+			// 收到中断信号后不再开始新的上传
+			if !fi.IsDir() {
+				stats.Add(fi.Size())
+				atomic.AddInt64(&unfinished, 1)
+				recordResult(pathname+"/"+fi.Name(), fi.Size(), "unfinished", "interrupted")
+			}
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi = fileutil.ResolveSymlink(pathname+"/"+fi.Name(), ancestors); fi == nil {
+				continue
+			}
+		}
+		if fileutil.Excluded(pathname+"/"+fi.Name(), fi) {
+			// 被排除的文件夹整个跳过
+			continue
+		}
 		if fi.IsDir() {
 			fullDir := pathname + "/" + fi.Name()
 			var tempFolderIDList []string
@@ -250,38 +282,118 @@ func UploadAllFile(pathname string, folderIDList []string, srv *drive.Service, s
 				tempFolderIDList = folderIDList
 			}
 			tempFolderIDList = append(tempFolderIDList, createFolder.Id)
-			_, err := UploadAllFile(fullDir, tempFolderIDList, srv, startTime, username, sendMsg, locText)
+			err := UploadAllFile(ctx, fullDir, tempFolderIDList, srv, locText)
 			if err != nil {
-				log.Panic("read dir fail:", err)
-				return nil, err
+				log.Panicf(locText("readDirFail"), err)
+				return err
 			}
 			//log.Println("folder", fi.Name(), fullDir)
-			// sendMsg(fmt.Sprintf(locText("googleDriveUploadTip"), username, fullDir, time.Now().Unix()-startTime))
-		} else {
+		} else if !fileutil.IsSpecial(fi.Mode()) {
+			// socket、FIFO 和设备文件无法上传，直接忽略
 			fullName := pathname + "/" + fi.Name()
 			var tempFolderIDList []string
 			if folderIDList == nil {
 				tempFolderIDList = folderIDList
 			}
 			tempFolderIDList = append(tempFolderIDList, createFolder.Id)
-			f, err := os.Open(fullName)
-			if err != nil {
-				log.Fatalf("error opening %q: %v", fullName, err)
-			}
-			defer f.Close()
+			// 文件在开始上传时才打开，打开的文件数不超过线程数
+			stats.Add(fi.Size())
 			//log.Println("file", fi.Name(), fullName)
 			//上傳檔案，create要給定檔案名稱，要傳進資料夾就加上Parents參數給定folderID的array，media傳入我們要上傳的檔案，最後Do
 			// _, err = srv.Files.Create(&drive.File{Name: fi.Name(), Parents: tempFolderIDList}).Media(f, googleapi.ChunkSize(chunkSize)).Do()
-			uploadFile(srv, fullName, fi.Name(), tempFolderIDList, f, sendMsg, locText, username)
-			if err != nil {
-				log.Panicf("Unable to create file: %v", err)
-			}
-			// sendMsg(fmt.Sprintf(locText("googleDriveUploadTip"), username, fullName, time.Now().Unix()-startTime))
+			uploadFile(ctx, srv, fullName, fi.Name(), tempFolderIDList, fileutil.FileInfo{Path: fullName, Size: fi.Size(), ModTime: fi.ModTime()})
 			//log.Printf("file: %+v", driveFile)
 		}
 	}
 	wg.Wait()
-	return temp, nil
+	return nil
+}
+
+// queryString escapes s for use in a Drive search query
+func queryString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// findChild returns the child of parents named name, folder selects whether a
+// folder or a file is looked for. It returns nil when there is none.
+func findChild(srv *drive.Service, name string, parents []string, folder bool) (*drive.File, error) {
+	parent := "root"
+	if len(parents) > 0 {
+		parent = parents[0]
+	}
+	q := fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false", queryString(name), queryString(parent))
+	if folder {
+		q += " and mimeType = 'application/vnd.google-apps.folder'"
+	} else {
+		q += " and mimeType != 'application/vnd.google-apps.folder'"
+	}
+	list, err := srv.Files.List().Q(q).Fields("files(id, name, size, md5Checksum)").PageSize(1).Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Files) == 0 {
+		return nil, nil
+	}
+	return list.Files[0], nil
+}
+
+// planFolder looks the folder up for the dry run without creating it, a
+// missing folder is recorded in the plan and has no id
+func planFolder(srv *drive.Service, pathname string, name string, parents []string) (*drive.File, error) {
+	if len(parents) == 0 || parents[0] != "" {
+		folder, err := findChild(srv, name, parents, true)
+		if err != nil || folder != nil {
+			return folder, err
+		}
+	}
+	fileutil.PlanFolder(remotePathOf(pathname))
+	return &drive.File{}, nil
+}
+
+// planFile records what the upload would do with the file. Google Drive keeps
+// files with the same name side by side, so a file is only skipped when the
+// index or -rescan-remote finds it already uploaded.
+func planFile(srv *drive.Service, filePath string, filename string, parents []string, fileInfo fileutil.FileInfo) {
+	atomic.AddInt64(&completed, 1)
+	remotePath := remotePathOf(filePath)
+	planned := fileutil.PlannedFile{Path: filePath, RemotePath: remotePath, Action: "upload", Size: fileInfo.Size}
+	if index.Unchanged("GoogleDrive", account, remotePath, fileInfo.Size, fileInfo.ModTime.Unix()) {
+		planned.Action, planned.Reason = "skip", "index"
+	} else if rescanRemote && (len(parents) == 0 || parents[0] != "") {
+		if existing, err := findChild(srv, filename, parents, false); err == nil && existing != nil && existing.Size == fileInfo.Size {
+			planned.Action, planned.Reason = "skip", "exists"
+		}
+	}
+	fileutil.PlanFile(planned)
+}
+
+// recordResult records how the upload of the local filePath ended
+func recordResult(filePath string, size int64, status string, reason string) {
+	remotePath := remotePathOf(filePath)
+	fileutil.RecordResult(fileutil.FileResult{Path: remotePath, RemotePath: remotePath, Status: status, Reason: reason, Size: size})
+}
+
+// recordFailure records that the file at filePath failed because of err
+func recordFailure(filePath string, size int64, reason string, err error) {
+	remotePath := remotePathOf(filePath)
+	fileutil.RecordResult(fileutil.FileResult{Path: remotePath, RemotePath: remotePath, Status: "failed", Reason: reason, Error: err.Error(), Size: size})
+}
+
+// remotePathOf returns the path of the local p on the drive
+func remotePathOf(p string) string {
+	remotePath, err := filepath.Rel(rootDir, p)
+	if err != nil {
+		remotePath = p
+	}
+	return filepath.ToSlash(remotePath)
+}
+
+func findOrCreateFolder(srv *drive.Service, name string, parents []string) (*drive.File, error) {
+	folder, err := findChild(srv, name, parents, true)
+	if err != nil || folder != nil {
+		return folder, err
+	}
+	return srv.Files.Create(&drive.File{Name: name, Parents: parents, MimeType: "application/vnd.google-apps.folder"}).Do()
 }
 
 func FileSizeFormat(bytes int64, forceBytes bool) string {
@@ -314,52 +426,151 @@ func MeasureTransferRate() func(int64) string {
 	}
 }
 
-func uploadFile(srv *drive.Service, filePath string, filename string, tempFolderIDList []string, f *os.File, sendMsg func() (func(text string), string, string, func(string, string, string) func(string)), locText func(text string) string, username string) {
+func uploadFile(ctx context.Context, srv *drive.Service, filePath string, filename string, tempFolderIDList []string, fileInfo fileutil.FileInfo) {
+	if fileutil.DryRun() {
+		planFile(srv, filePath, filename, tempFolderIDList, fileInfo)
+		return
+	}
 	wg.Add(1)
 	pool <- struct{}{}
-	startTime := time.Now().Unix()
 	go func() {
 		defer wg.Done()
 		defer func() {
 			<-pool
 		}()
-		temps, _botKey, iUserID, botSend := sendMsg()
-		var iSendMsg func(string)
-		tip := "`" + filePath + "`" + locText("startToUpload1")
-		if _botKey != "" && iUserID != "" {
-			iSendMsg = botSend(_botKey, iUserID, tip)
+		// 仍在写入的文件等到写完再上传，读取目录后被删除的文件跳过
+		if err := fileutil.WaitStable(&fileInfo); err == fileutil.ErrVanished {
+			atomic.AddInt64(&completed, 1)
+			recordResult(filePath, fileInfo.Size, "skipped", "vanished")
+			return
+		} else if err == fileutil.ErrChanged {
+			// 一直在变化的文件记为失败，unfinished 只统计因中断没有上传的文件
+			recordResult(filePath, fileInfo.Size, "failed", "unstable")
+			return
+		} else if err != nil {
+			// 无法读取的文件记为失败，不影响其他文件
+			recordFailure(filePath, fileInfo.Size, "read", err)
+			return
 		}
-		temp := func(text string) {
-			temps(text)
-			if _botKey != "" && iUserID != "" {
-				iSendMsg(text)
-			}
+		if err := fileInfo.Open(); err == fileutil.ErrVanished {
+			atomic.AddInt64(&completed, 1)
+			recordResult(filePath, fileInfo.Size, "skipped", "vanished")
+			return
+		} else if err != nil {
+			recordFailure(filePath, fileInfo.Size, "read", err)
+			return
 		}
-		fi, err := os.Stat(filePath)
+		defer fileInfo.Close()
+		fi, err := fileInfo.FileData.Stat()
 		if err != nil {
-			fi, err = os.Stat(filename)
-			if err != nil {
-				log.Panicln(err)
+			recordFailure(filePath, fileInfo.Size, "read", err)
+			return
+		}
+		remotePath := remotePathOf(filePath)
+		entry := fileutil.IndexEntry{Path: remotePath, Size: fileInfo.Size, ModTime: fileInfo.ModTime.Unix(), Backend: "GoogleDrive", Account: account}
+		indexed := index.Unchanged(entry.Backend, entry.Account, entry.Path, entry.Size, entry.ModTime)
+		if !indexed && rescanRemote {
+			existing, err := findChild(srv, filename, tempFolderIDList, false)
+			if err == nil && existing != nil && existing.Size == entry.Size {
+				entry.ItemID, entry.HashType, entry.Hash = existing.Id, "md5Checksum", existing.Md5Checksum
+				if err := index.Add(entry); err != nil {
+					log.Println(err)
+				}
+				indexed = true
 			}
 		}
-		getRate := MeasureTransferRate()
-		size := fi.Size()
-		// log.Println(byte2Readable(float64(size)))
-
+		if indexed {
+			atomic.AddInt64(&completed, 1)
+			recordResult(filePath, fileInfo.Size, "skipped", "index")
+			if fileutil.AfterUpload() {
+				// 索引只说明以前上传过，删除或移走本地文件前确认网盘中的文件仍然存在并且相同
+				existing, err := findChild(srv, filename, tempFolderIDList, false)
+				if err == nil && existing == nil {
+					err = fileutil.ErrNotOnDrive
+				}
+				if err != nil {
+					notify.Publish(notify.SourceKept{Path: remotePath, Err: err})
+				} else {
+					finishSource(filePath, remotePath, &fileInfo, existing.Size, existing.Md5Checksum)
+				}
+			}
+			return
+		}
+		size := fileInfo.Size
+		begun := time.Now()
+		started := begun
 		showProgress := func(current, total int64) {
-			temp(fmt.Sprintf(locText("googleDriveUploadTip1"), username, filePath, byte2Readable(float64(size)), byte2Readable(float64(current)), int(math.Ceil(float64(current)/float64(chunkSize))), int(math.Ceil(float64(size)/float64(chunkSize))), getRate(current), time.Now().Unix()-startTime))
+			elapsed := time.Since(started)
+			progress := notify.ChunkUploaded{Path: remotePath, Size: size, Bytes: current, Chunk: int(math.Ceil(float64(current) / float64(chunkSize))), Chunks: int(math.Ceil(float64(size) / float64(chunkSize))), Elapsed: elapsed}
+			if elapsed > 0 {
+				progress.Speed = int64(float64(current) / elapsed.Seconds())
+			}
+			notify.Publish(progress)
 		}
 
-		_, err = srv.Files.Create(&drive.File{Name: filename, Parents: tempFolderIDList}).Media(f, googleapi.ChunkSize(chunkSize)).ProgressUpdater(showProgress).Do()
+		// 正在上传的文件在第一次中断信号后仍然会传完
+		// 保留本地文件的创建和修改时间，而不是上传时间
+		file := &drive.File{
+			Name:         filename,
+			Parents:      tempFolderIDList,
+			CreatedTime:  fileutil.CreationTime(fi).UTC().Format(time.RFC3339),
+			ModifiedTime: fileInfo.ModTime.UTC().Format(time.RFC3339),
+		}
+		notify.Publish(notify.FileStarted{Path: remotePath, RemotePath: remotePath, Size: fileInfo.Size})
+		uploaded, err := srv.Files.Create(file).Media(fileInfo.FileData, googleapi.ChunkSize(chunkSize)).ProgressUpdater(showProgress).Fields("id, size, md5Checksum, webViewLink").Context(httpLocal.Detach(ctx)).Do()
 		if err != nil {
-			log.Panicln(err)
+			fileutil.RecordResult(fileutil.FileResult{Path: remotePath, RemotePath: remotePath, Status: "failed", Reason: "upload", Error: err.Error(), Size: fileInfo.Size})
+			return
 		}
-
-		defer temp("close=")
+		// 上传期间文件被改写时，等写完后用新的内容更新同一个文件
+		for i := 0; ; i++ {
+			if _, changed, err := fileInfo.Changed(); !changed || err != nil {
+				break
+			}
+			if i == maxRequeue {
+				recordResult(filePath, fileInfo.Size, "failed", "unstable")
+				return
+			}
+			notify.Publish(notify.Retrying{Path: remotePath, Reason: "changed", Attempt: i + 1})
+			if err := fileutil.WaitStable(&fileInfo); err != nil {
+				break
+			}
+			if _, err := fileInfo.FileData.Seek(0, io.SeekStart); err != nil {
+				recordFailure(filePath, fileInfo.Size, "read", err)
+				return
+			}
+			size, started = fileInfo.Size, time.Now()
+			update := &drive.File{ModifiedTime: fileInfo.ModTime.UTC().Format(time.RFC3339)}
+			uploaded, err = srv.Files.Update(uploaded.Id, update).Media(fileInfo.FileData, googleapi.ChunkSize(chunkSize)).ProgressUpdater(showProgress).Fields("id, size, md5Checksum, webViewLink").Context(httpLocal.Detach(ctx)).Do()
+			if err != nil {
+				fileutil.RecordResult(fileutil.FileResult{Path: remotePath, RemotePath: remotePath, Status: "failed", Reason: "upload", Error: err.Error(), Size: fileInfo.Size})
+				return
+			}
+		}
+		entry.Size, entry.ModTime = fileInfo.Size, fileInfo.ModTime.Unix()
+		atomic.AddInt64(&completed, 1)
+		entry.ItemID, entry.HashType, entry.Hash = uploaded.Id, "md5Checksum", uploaded.Md5Checksum
+		if err := index.Add(entry); err != nil {
+			log.Println(err)
+		}
+		fileutil.RecordResult(fileutil.FileResult{Path: remotePath, RemotePath: remotePath, Status: "uploaded", Size: fileInfo.Size, ItemID: uploaded.Id, WebURL: uploaded.WebViewLink, Elapsed: time.Since(begun)})
+		finishSource(filePath, remotePath, &fileInfo, uploaded.Size, uploaded.Md5Checksum)
 	}()
 
 }
 
+// finishSource deletes or moves the uploaded local file as -delete-after and
+// -move-after say, size and md5 are those of the file on the drive
+func finishSource(filePath string, remotePath string, fileInfo *fileutil.FileInfo, size int64, md5 string) {
+	if !fileutil.AfterUpload() {
+		return
+	}
+	fileInfo.Close()
+	if err := fileutil.FinishSource(filePath, remotePath, size, "md5Checksum", md5); err != nil {
+		notify.Publish(notify.SourceKept{Path: remotePath, Err: err})
+	}
+}
+
 /*func main() {
 	UploadAllFile("test")
 }*/
@@ -388,21 +599,22 @@ func gdInit() (ctx context.Context, config *oauth2.Config) {
 	}
 	return
 }
-func CreateNewInfo(code string, lang string) string {
+func CreateNewInfo(code string, lang string, locText func(text string) string) string {
 	ctx, config := gdInit()
-	tok, err := config.Exchange(oauth2.NoContext, code)
+	ctx = oauthContext(ctx)
+	tok, err := config.Exchange(ctx, code)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		log.Fatalf(locText("googleDriveTokenFail"), err)
 	}
 	client := config.Client(ctx, tok)
 	srv, err := drive.New(client)
 	if err != nil {
-		log.Fatalf("Unable to retrieve drive Client %v", err)
+		log.Fatalf(locText("googleDriveClientFail"), err)
 	}
 
 	userInfo, err := srv.About.Get().Fields("user").Do()
 	if err != nil {
-		log.Fatalf("An error occurred: %v\n", err)
+		log.Fatalf(locText("googleDriveUserFail"), err)
 	}
 
 	//log.Printf("%+v", userInfo.User.EmailAddress)
@@ -410,13 +622,30 @@ func CreateNewInfo(code string, lang string) string {
 	return "./" + userInfo.User.EmailAddress + ".json"
 }
 
-func Upload(infoPath string, filePath string, sendMsg func() (func(text string), string, string, func(string, string, string) func(string)), locText func(text string) string, Thread int, BlockSize int, Language string, TimeOut int, BotKey string, UserID string) {
-	ctx, config := gdInit()
+// Upload uploads filePath to Google Drive. Cancelling ctx stops starting new
+// files, the returned counts are the completed and the unfinished files.
+// Files recorded unchanged in uploadIndex are skipped, rescan rebuilds the
+// index from the files already on the drive.
+func Upload(ctx context.Context, infoPath string, filePath string, uploadIndex *fileutil.Index, rescan bool, scanStats *fileutil.ScanStats, locText func(text string) string, Thread int, BlockSize int, Language string, TimeOut int, BotKey string, UserID string) (int, int) {
+	_, config := gdInit()
 	infoPath, _ = filepath.Abs(infoPath)
+	if transport == nil {
+		transport, _ = httpLocal.NewTransport(httpLocal.TransportConfig{Threads: Thread})
+	}
 	tok, _ := tokenFromFile(config, infoPath, Thread, BlockSize, Language, TimeOut, BotKey, UserID)
-	client := config.Client(ctx, tok)
+	// 分块上传使用进度看门狗，长时间没有数据发送时中断并重试
+	// 刷新 token 使用的 context 不随中断信号取消，保证正在上传的文件可以传完
+	clientCtx := context.WithValue(httpLocal.Detach(ctx), oauth2.HTTPClient, &http.Client{
+		Transport: httpLocal.NewStallTransport(transport, time.Duration(TimeOut)*time.Second, int64(fileutil.GetMinSpeed())*1024),
+	})
+	client := config.Client(clientCtx, tok)
 	srv, err := drive.New(client)
 	username := strings.ReplaceAll(filepath.Base(infoPath), ".json", "")
+	index, rescanRemote, account, stats = uploadIndex, rescan, username, scanStats
+	rootDir = filepath.Dir(filePath)
+	if rescanRemote {
+		index.Reset("GoogleDrive", account)
+	}
 	// restoreOption := "orig"
 	oldDir, err := os.Getwd()
 	if err != nil {
@@ -429,15 +658,22 @@ func Upload(infoPath string, filePath string, sendMsg func() (func(text string),
 	}
 
 	if err != nil {
-		log.Fatalf("Unable to retrieve drive Client %v", err)
+		log.Fatalf(locText("googleDriveClientFail"), err)
 
 	}
-	temp, _ := UploadAllFile(filePath, nil, srv, time.Now().Unix(), username, sendMsg, locText)
-	temp(locText("uploadGoogleDriveComplete"))
+	fileutil.StartFilter(filePath)
+	ancestors = fileutil.SourceAncestors(filePath)
+	UploadAllFile(ctx, filePath, nil, srv, locText)
+	stats.Finish()
+	if fileutil.AfterUpload() && !fileutil.DryRun() {
+		// 文件删除或移走后留下的空文件夹一并删除
+		fileutil.RemoveEmptyDirs(filePath)
+	}
 	err = os.Chdir(oldDir)
 	if err != nil {
 		log.Panic(err)
 	}
+	return int(atomic.LoadInt64(&completed)), int(atomic.LoadInt64(&unfinished))
 }
 
 func main() {
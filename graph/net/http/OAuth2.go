@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Certificate struct {
@@ -21,9 +22,19 @@ type Certificate struct {
 	MainLand     bool        `json:"MainLand"`
 	Language     string      `json:"Language"`
 	TimeOut      int         `json:"TimeOut"`
+	MinSpeed     int         `json:"MinSpeed,omitempty"`
 	BotKey       string      `json:"BotKey"`
 	UserID       string      `json:"UserID"`
 	Other        interface{} `json:"Other"`
+
+	// 网络设置：Graph/Google 与 Telegram 可以分别使用不同的代理
+	Proxy         string `json:"Proxy,omitempty"`
+	TelegramProxy string `json:"TelegramProxy,omitempty"`
+	CABundle      string `json:"CABundle,omitempty"`
+	LocalAddr     string `json:"LocalAddr,omitempty"`
+
+	// 按路径指定的冲突策略，形如 "*.log=replace"
+	ConflictRules []string `json:"ConflictRules,omitempty"`
 }
 
 var GraphURL = "https://graph.microsoft.com/v1.0/me/"
@@ -45,12 +56,11 @@ func NewPassCheck(oauth2URL string, ms int, lang string) string {
 	url := GraphURL
 	req, err := http.NewRequest("GET", url, nil)
 	req.Header.Set("Authorization", "Bearer "+Bearer)
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		// handle error
 	}
-	defer resp.Body.Close()
+	defer DrainBody(resp)
 	body, _ := ioutil.ReadAll(resp.Body)
 	var mail string
 	if ms == 1 {
@@ -86,11 +96,26 @@ type UserData struct {
 
 var tempUserData UserData
 
+// tokenCache keeps the access token until shortly before it expires and the
+// user ID for the whole run, so they are not requested again for every file
+// 缓存 access token 和用户 ID，避免每个文件都重新读取配置、刷新 token 并请求 /me
+type tokenCache struct {
+	mutex    sync.Mutex
+	infoPath string
+	bearer   string
+	expiry   time.Time
+	myID     string
+}
+
+// tokenExpiryMargin 在 token 过期前提前刷新的时间
+const tokenExpiryMargin = 5 * time.Minute
+
+var cache tokenCache
+
 // GetMyIDAndBearer is get microsoft ID and access Certificate
 func GetMyIDAndBearer(infoPath string, Thread int, BlockSize int, Language string, TimeOut int, BotKey string, UserID string) (string, string) {
-	MyID := ""
-	Bearer := ""
-	_, err := os.Stat(infoPath)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
 	tempUserData = UserData{
 		infoPath:  infoPath,
 		Thread:    Thread,
@@ -100,19 +125,25 @@ func GetMyIDAndBearer(infoPath string, Thread int, BlockSize int, Language strin
 		BotKey:    BotKey,
 		UserID:    UserID,
 	}
-	Bearer = refreshAccessToken(infoPath, Thread, BlockSize, Language, TimeOut, BotKey, UserID)
+	if cache.infoPath != infoPath {
+		cache.infoPath, cache.bearer, cache.myID = infoPath, "", ""
+	}
+	Bearer := cache.getBearer(false)
+	if cache.myID != "" {
+		return cache.myID, Bearer
+	}
+
 	url := GraphURL
 	req, err := http.NewRequest("GET", url, nil)
 	req.Header.Set("Authorization", "Bearer "+Bearer)
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		// handle error
 	}
-	defer resp.Body.Close()
+	defer DrainBody(resp)
 	body, _ := ioutil.ReadAll(resp.Body)
 
-	MyID, err = jsonparser.GetString(body, "id")
+	MyID, err := jsonparser.GetString(body, "id")
 	if err != nil {
 		log.Println(string(body))
 		log.Panicln(err)
@@ -120,12 +151,34 @@ func GetMyIDAndBearer(infoPath string, Thread int, BlockSize int, Language strin
 
 	//os.Rename("info.json", mail+".json")
 	// log.Println(MyID)
-
+	cache.myID = MyID
 	return MyID, Bearer
 }
 
+// GetBearer returns the cached access token, it is refreshed when it is about to expire
 func GetBearer() string {
-	return refreshAccessToken(tempUserData.infoPath, tempUserData.Thread, tempUserData.BlockSize, tempUserData.Language, tempUserData.TimeOut, tempUserData.BotKey, tempUserData.UserID)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.getBearer(false)
+}
+
+// RefreshBearer drops the cached access token and requests a new one, it is
+// used when the API answered 401 Unauthorized
+func RefreshBearer() string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.getBearer(true)
+}
+
+// getBearer must be called with the mutex held
+func (c *tokenCache) getBearer(force bool) string {
+	if !force && c.bearer != "" && time.Now().Add(tokenExpiryMargin).Before(c.expiry) {
+		return c.bearer
+	}
+	bearer, expiresIn := refreshAccessToken(tempUserData.infoPath, tempUserData.Thread, tempUserData.BlockSize, tempUserData.Language, tempUserData.TimeOut, tempUserData.BotKey, tempUserData.UserID)
+	c.bearer = bearer
+	c.expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return bearer
 }
 
 func getAccessToken(oauth2URL string, ms int, lang string) string {
@@ -150,12 +203,11 @@ func getAccessToken(oauth2URL string, ms int, lang string) string {
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Host = Host
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		// handle error
 	}
-	defer resp.Body.Close()
+	defer DrainBody(resp)
 	body, _ := ioutil.ReadAll(resp.Body)
 	//log.Println(string(body))
 	accessToken, err := jsonparser.GetString(body, "access_token")
@@ -200,12 +252,13 @@ func getAccessToken(oauth2URL string, ms int, lang string) string {
 	return accessToken
 }
 
-func refreshAccessToken(path string, Thread int, BlockSize int, Language string, TimeOut int, BotKey string, UserID string) string {
+// refreshAccessToken returns a new access token and its lifetime in seconds
+func refreshAccessToken(path string, Thread int, BlockSize int, Language string, TimeOut int, BotKey string, UserID string) (string, int64) {
 	mutex.Lock() //使用互斥锁防止线程数过高时信息被覆盖问题
 	filePtr, err := os.Open(path)
 	if err != nil {
 		log.Panicln(err)
-		return ""
+		return "", 0
 	}
 	defer filePtr.Close()
 	var info Certificate
@@ -222,12 +275,11 @@ func refreshAccessToken(path string, Thread int, BlockSize int, Language string,
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Host = Host
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		// handle error
 	}
-	defer resp.Body.Close()
+	defer DrainBody(resp)
 	body, _ := ioutil.ReadAll(resp.Body)
 	//fmt.Println(string(body))
 	accessToken, err := jsonparser.GetString(body, "access_token")
@@ -235,28 +287,31 @@ func refreshAccessToken(path string, Thread int, BlockSize int, Language string,
 		log.Panicln(err)
 	}
 	//log.Println(accessToken)
+	expiresIn, err := jsonparser.GetInt(body, "expires_in")
+	if err != nil {
+		expiresIn = 3600
+	}
 	refreshToken, err := jsonparser.GetString(body, "refresh_token")
 	if err != nil {
 		log.Panicln(err)
 	}
 	// log.Println(refreshToken)
 
-	info = Certificate{
-		Drive:        "OneDrive",
-		RefreshToken: refreshToken,
-		ThreadNum:    Thread,
-		BlockSize:    BlockSize,
-		MainLand:     isCN,
-		Language:     Language,
-		TimeOut:      TimeOut,
-		BotKey:       BotKey,
-		UserID:       UserID,
-	}
+	// 只更新命令行相关的字段，保留配置文件中的其他设置
+	info.Drive = "OneDrive"
+	info.RefreshToken = refreshToken
+	info.ThreadNum = Thread
+	info.BlockSize = BlockSize
+	info.MainLand = isCN
+	info.Language = Language
+	info.TimeOut = TimeOut
+	info.BotKey = BotKey
+	info.UserID = UserID
 	// 创建文件
 	filePtr, err = os.Create(path)
 	if err != nil {
 		log.Panicln(err.Error())
-		return ""
+		return "", 0
 	}
 	defer filePtr.Close()
 	// 创建Json编码器
@@ -266,5 +321,5 @@ func refreshAccessToken(path string, Thread int, BlockSize int, Language string,
 	if err != nil {
 		log.Panicln(err.Error())
 	}
-	return accessToken
+	return accessToken, expiresIn
 }
@@ -0,0 +1,35 @@
+package http
+
+import (
+	"context"
+	"time"
+)
+
+// detachedContext keeps the values of its parent but is never cancelled.
+// 第一次收到中断信号时取消的是调度用的 context，正在传输的分块使用 Detach 后的 context，
+// 这样可以先把当前分块传完，再保存断点
+type detachedContext struct {
+	parent context.Context
+}
+
+// Detach returns a context that carries the values of ctx but ignores its
+// cancellation and deadline.
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -1,11 +1,16 @@
 package http
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+)
 
 // error types
 
 var (
 	ErrFileTooLarge = errors.New("file is too large for simple upload")
+	ErrStalled      = errors.New("upload stalled, no data was sent before the timeout")
+	ErrInterrupted  = errors.New("upload interrupted, progress was saved for resuming")
 )
 
 type innerError struct {
@@ -19,8 +24,23 @@ type innerError struct {
 // See: http://onedrive.github.io/misc/errors.htm
 type Error struct {
 	innerError `json:"error"`
+	StatusCode int `json:"-"`
 }
 
 func (e Error) Error() string {
 	return e.Message
 }
+
+// IsUnauthorized reports whether err is a 401 answer of the API, which means
+// the access token has to be refreshed
+func IsUnauthorized(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusUnauthorized
+}
+
+// IsConflict reports whether err means the upload was refused because of the
+// remote file: 409 for conflictBehavior fail, 412 for a stale If-Match eTag
+func IsConflict(err error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusPreconditionFailed)
+}
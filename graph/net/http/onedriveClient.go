@@ -133,8 +133,11 @@ func (od *OneDrive) Do(req *http.Request) (*http.Response, error) {
 	//defer resp.Body.Close()
 
 	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode <= statusInsufficientStorage {
-		newErr := new(Error)
-		if err := json.NewDecoder(resp.Body).Decode(newErr); err != nil {
+		newErr := &Error{StatusCode: resp.StatusCode}
+		err := json.NewDecoder(resp.Body).Decode(newErr)
+		// 错误响应的 body 在这里读完，保证连接可以复用
+		DrainBody(resp)
+		if err != nil {
 			return resp, err
 		}
 		return resp, newErr
@@ -0,0 +1,145 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// transport is shared by the Graph API, token and /me requests, so TLS
+// connections are reused instead of being set up again for every small file
+// Graph、token 和 /me 请求共用同一个 transport，复用连接，避免小文件上传时大部分时间花在 TLS 握手上
+var transport, _ = NewTransport(TransportConfig{Threads: 3})
+var client = &http.Client{Transport: transport}
+
+// TransportConfig describes how a backend reaches the network
+type TransportConfig struct {
+	// Threads is the number of upload threads, the idle connection limits are matched to it
+	Threads int
+	// Proxy is an http://, https:// or socks5:// URL, an empty value uses HTTPS_PROXY and friends
+	Proxy string
+	// CABundle is a PEM file whose certificates are trusted in addition to the system roots
+	CABundle string
+	// LocalAddr is the local IP address or interface name outgoing connections are bound to
+	LocalAddr string
+}
+
+// NewTransport returns a keep-alive transport with HTTP/2 enabled, configured
+// with the proxy, CA bundle and source address of config.
+func NewTransport(config TransportConfig) (*http.Transport, error) {
+	threads := config.Threads
+	if threads < 1 {
+		threads = 1
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          threads * 4,
+		MaxIdleConnsPerHost:   threads * 2,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", config.Proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", proxyURL.Scheme)
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.CABundle != "" {
+		pem, err := ioutil.ReadFile(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %q", config.CABundle)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if config.LocalAddr != "" {
+		addr, err := resolveLocalAddr(config.LocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = addr
+	}
+	return t, nil
+}
+
+// resolveLocalAddr accepts a local IP address or a network interface name,
+// an interface is bound to its first IPv4 address if it has one
+func resolveLocalAddr(s string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("local address %q is neither an IP nor an interface: %v", s, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("interface %q has no IP address", s)
+	}
+	return &net.TCPAddr{IP: found}, nil
+}
+
+// SetTransport replaces the transport shared by the Graph backend
+func SetTransport(t *http.Transport) {
+	transport = t
+	client = &http.Client{Transport: t}
+}
+
+// Transport returns the transport shared by the Graph backend
+func Transport() *http.Transport {
+	return transport
+}
+
+// DrainBody reads the rest of the response body and closes it, so the
+// connection can go back to the idle pool
+func DrainBody(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
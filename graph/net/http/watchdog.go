@@ -0,0 +1,153 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// stallTransport aborts a request when its body has not moved for the stall
+// timeout. The deadline of the whole request is derived from the body size and
+// the minimum acceptable speed, so a slow but healthy chunk is not killed.
+// 当请求体在 stall 时间内没有任何数据发送时中断请求，整个请求的超时时间由分块大小和最低速度计算
+type stallTransport struct {
+	base     http.RoundTripper
+	stall    time.Duration
+	minSpeed int64
+}
+
+// NewStallTransport wraps base with a progress based watchdog. minSpeed is in
+// bytes per second, a value <= 0 disables the overall deadline.
+func NewStallTransport(base http.RoundTripper, stall time.Duration, minSpeed int64) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &stallTransport{base: base, stall: stall, minSpeed: minSpeed}
+}
+
+// deadline returns the time a request with the given body size may take at most
+func (t *stallTransport) deadline(size int64) time.Duration {
+	if t.minSpeed <= 0 || size <= 0 {
+		return 0
+	}
+	return t.stall + time.Duration(size/t.minSpeed)*time.Second
+}
+
+func (t *stallTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.stall <= 0 {
+		return t.base.RoundTrip(req)
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if d := t.deadline(req.ContentLength); d > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), d)
+	} else if req.Body == nil || req.Body == http.NoBody {
+		// 没有请求体时，只要求服务器在 stall 时间内响应
+		ctx, cancel = context.WithTimeout(req.Context(), t.stall)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+
+	r := req.Clone(ctx)
+	var body *progressBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = newProgressBody(req.Body)
+		r.Body = body
+		go body.watch(t.stall, cancel)
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if body != nil {
+		body.finish()
+	}
+	if err != nil {
+		cancel()
+		if body != nil && body.isStalled() {
+			return nil, ErrStalled
+		}
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// progressBody records the last time any byte of the request body was read
+type progressBody struct {
+	io.ReadCloser
+	mu      sync.Mutex
+	last    time.Time
+	stalled bool
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newProgressBody(rc io.ReadCloser) *progressBody {
+	return &progressBody{ReadCloser: rc, last: time.Now(), done: make(chan struct{})}
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if n > 0 {
+		b.last = time.Now()
+	}
+	b.mu.Unlock()
+	if err == io.EOF {
+		// 请求体已全部发出，之后等待服务器处理的时间由整体超时负责
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *progressBody) finish() {
+	b.once.Do(func() {
+		close(b.done)
+	})
+}
+
+func (b *progressBody) isStalled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stalled
+}
+
+// watch cancels the request when no bytes moved for the stall timeout
+func (b *progressBody) watch(stall time.Duration, cancel context.CancelFunc) {
+	interval := stall / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			idle := time.Since(b.last)
+			if idle >= stall {
+				b.stalled = true
+			}
+			b.mu.Unlock()
+			if idle >= stall {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// cancelBody releases the request context once the response has been read
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
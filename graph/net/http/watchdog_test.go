@@ -0,0 +1,125 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testStall 是测试中的 stall 超时时间
+const testStall = 500 * time.Millisecond
+
+// zeroReader reads zeros forever
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// trickleReader returns one small part of data every interval
+type trickleReader struct {
+	data     []byte
+	part     int
+	interval time.Duration
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.interval)
+	n := r.part
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// roundTrip sends body to srv through a stall transport and fails the test
+// when it has not returned after timeout
+func roundTrip(t *testing.T, srv *httptest.Server, body io.Reader, size int64, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequest("PUT", srv.URL, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = size
+	transport := NewStallTransport(srv.Client().Transport, testStall, 0)
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := transport.RoundTrip(req)
+		done <- result{resp, err}
+	}()
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-time.After(timeout):
+		t.Fatalf("request still running after %v", timeout)
+		return nil, nil
+	}
+}
+
+func TestStallTransportCancelsStalledUpload(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 读取一部分请求体后不再读取，直到测试结束
+		_, _ = io.CopyN(ioutil.Discard, r.Body, 1<<20)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	// 请求体远大于连接的缓冲区，服务器停止读取后发送会停住
+	started := time.Now()
+	resp, err := roundTrip(t, srv, io.LimitReader(zeroReader{}, 1<<30), 1<<30, 20*time.Second)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != ErrStalled {
+		t.Fatalf("got %v, want ErrStalled", err)
+	}
+	if elapsed := time.Since(started); elapsed < testStall {
+		t.Errorf("cancelled after %v, before the stall timeout", elapsed)
+	}
+}
+
+func TestStallTransportKeepsSlowUpload(t *testing.T) {
+	var received int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received = len(data)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	// 每次只发送很少的数据，总时间是 stall 超时的几倍，但数据一直在发送
+	data := bytes.Repeat([]byte("x"), 30*512)
+	body := &trickleReader{data: data, part: 512, interval: testStall / 10}
+	resp, err := roundTrip(t, srv, body, int64(len(data)), 20*time.Second)
+	if err != nil {
+		t.Fatalf("slow upload cancelled: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || received != len(data) {
+		t.Errorf("got status %d with %d bytes, want %d bytes", resp.StatusCode, received, len(data))
+	}
+}
@@ -1,40 +1,68 @@
 package main
 
 import (
+	"embed"
 	"fmt"
 	"io/ioutil"
 	"log"
+	httpLocal "main/graph/net/http"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
-	"time"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"golang.org/x/text/language"
 )
 
+// catalogs 是编译进程序的语言文件，离线或无法访问 jsDelivr 时也能正常启动
+//go:embed i18n/*.toml
+var catalogs embed.FS
+
 var bundle *i18n.Bundle
 
+// embedded 是内置语言文件中的消息，按语言和 ID 索引，用来检查其他位置的语言文件是否与程序匹配
+var embedded = make(map[language.Tag]map[string]*i18n.Message)
+
+// unmarshalFuncs 是解析语言文件使用的格式
+var unmarshalFuncs = map[string]i18n.UnmarshalFunc{"toml": toml.Unmarshal}
+
+// i18nClient 用于下载语言文件
+var i18nClient = newI18nClient()
+
+func newI18nClient() *http.Client {
+	t, _ := httpLocal.NewTransport(httpLocal.TransportConfig{Threads: 1})
+	return &http.Client{Transport: t}
+}
+
+// catalogURL 是 -update-lang 下载语言文件的地址
+const catalogURL = "https://cdn.jsdelivr.net/gh/gaowanliang/OneDriveUploader/i18n/%s.toml"
+
 func init() {
-	bundle = i18n.NewBundle(language.SimplifiedChinese)
+	// 缺少翻译的文本回退到英文
+	bundle = i18n.NewBundle(language.English)
 	bundle.RegisterUnmarshalFunc("toml", toml.Unmarshal)
-	dir, err := os.Executable()
+	entries, err := catalogs.ReadDir("i18n")
 	dropErr(err)
-	dir = filepath.Dir(dir)
-	// fmt.Println(dir)
-	rd, err := ioutil.ReadDir(dir)
-	if err != nil {
-		log.Panic(err)
-	}
-	for _, fi := range rd {
-		if !fi.IsDir() && path.Ext(fi.Name()) == ".toml" {
-			bundle.LoadMessageFile(path.Join(dir, fi.Name()))
+	for _, entry := range entries {
+		data, err := catalogs.ReadFile(path.Join("i18n", entry.Name()))
+		dropErr(err)
+		file, err := bundle.ParseMessageFileBytes(data, entry.Name())
+		dropErr(err)
+		messages := make(map[string]*i18n.Message, len(file.Messages))
+		for _, message := range file.Messages {
+			messages[message.ID] = message
 		}
+		embedded[file.Tag] = messages
+	}
+	// 程序所在目录和配置目录中的语言文件优先于内置的语言文件，后加载的覆盖先加载的
+	// 旧版本留下的语言文件与程序不匹配时不使用
+	for _, dir := range catalogDirs() {
+		loadCatalogDir(dir)
 	}
-
 }
 
 func dropErr(err error) {
@@ -43,97 +71,189 @@ func dropErr(err error) {
 	}
 }
 
-func pageDownload(url string) string {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	// 自定义Header
-	req.Header.Set("User-Agent", "Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1)")
+// catalogDirs returns the directories searched for override catalogs, from the
+// lowest to the highest precedence: next to the binary, then the config directory
+func catalogDirs() []string {
+	var dirs []string
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	if dir := userCatalogDir(); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
 
-	resp, err := client.Do(req)
+// userCatalogDir 返回用户配置目录中存放语言文件的位置，例如 ~/.config/LightUploader
+func userCatalogDir() string {
+	dir, err := os.UserConfigDir()
 	if err != nil {
-		fmt.Println("http get error", err)
 		return ""
 	}
-	//函数结束后关闭相关链接
-	defer resp.Body.Close()
+	return filepath.Join(dir, "LightUploader")
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+func loadCatalogDir(dir string) {
+	rd, err := ioutil.ReadDir(dir)
 	if err != nil {
-		fmt.Println("read error", err)
-		return ""
+		return
+	}
+	for _, fi := range rd {
+		if fi.IsDir() || path.Ext(fi.Name()) != ".toml" {
+			continue
+		}
+		p := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		file, err := parseCatalog(data, p)
+		if err != nil {
+			log.Printf("%s is ignored: %v", p, err)
+			continue
+		}
+		if err := bundle.AddMessages(file.Tag, file.Messages...); err != nil {
+			log.Println(err)
+		}
 	}
-	return string(body)
 }
 
-func GetFileModTime(path string) int64 {
-	f, err := os.Open(path)
-	dropErr(err)
-	defer f.Close()
-
-	fi, err := f.Stat()
-	dropErr(err)
-
-	return fi.ModTime().Unix()
+// parseCatalog parses the catalog data read from p and checks it against the
+// embedded catalog of its language, or the English one when there is none.
+// The catalog must have every message of it with the same format verbs.
+func parseCatalog(data []byte, p string) (*i18n.MessageFile, error) {
+	file, err := i18n.ParseMessageFileBytes(data, p, unmarshalFuncs)
+	if err != nil {
+		return nil, err
+	}
+	want, ok := embedded[file.Tag]
+	if !ok {
+		want = embedded[language.English]
+	}
+	got := make(map[string]*i18n.Message, len(file.Messages))
+	for _, message := range file.Messages {
+		got[message.ID] = message
+	}
+	for id, message := range want {
+		override, ok := got[id]
+		if !ok {
+			return nil, fmt.Errorf("message %s is missing", id)
+		}
+		if verbs, wantVerbs := formatVerbs(override.Other), formatVerbs(message.Other); verbs != wantVerbs {
+			return nil, fmt.Errorf("message %s has the format verbs %q instead of %q", id, verbs, wantVerbs)
+		}
+	}
+	return file, nil
 }
 
-type Loc struct {
-	localize *i18n.Localizer
+// verbPattern 匹配 fmt 的格式化动词
+var verbPattern = regexp.MustCompile(`%[-+# 0]*[0-9]*(\.[0-9]+)?[a-zA-Z%]`)
+
+// formatVerbs returns the fmt verbs of text in order, such as "%s%d"
+func formatVerbs(text string) string {
+	return strings.Join(verbPattern.FindAllString(text, -1), "")
 }
 
-func (loc *Loc) init(locLanguage string) {
-	dir, err := os.Executable()
-	dropErr(err)
-	dir = filepath.Dir(dir)
-	//fmt.Println(dir)
-	dir = filepath.Join(dir, fmt.Sprintf("%s.toml", locLanguage))
-	_, err = os.Stat(dir)
+// updateCatalog downloads the latest catalog of locLanguage into the config
+// directory, it is only run when asked for with -update-lang
+func updateCatalog(locLanguage string) (string, error) {
+	dir := userCatalogDir()
+	if dir == "" {
+		return "", fmt.Errorf("no config directory to save the language file to")
+	}
+	resp, err := i18nClient.Get(fmt.Sprintf(catalogURL, locLanguage))
 	if err != nil {
-		resp, err := http.Get(fmt.Sprintf("https://cdn.jsdelivr.net/gh/gaowanliang/OneDriveUploader/i18n/%s.toml", locLanguage))
-		dropErr(err)
-		defer resp.Body.Close()
-		data, err := ioutil.ReadAll(resp.Body)
-		dropErr(err)
-		ioutil.WriteFile(dir, data, 0666)
-	} else {
-		url := "https://cdn.jsdelivr.net/gh/gaowanliang/OneDriveUploader@latest/i18n/"
-		j := pageDownload(url)
-		var re = regexp.MustCompile(`(?m)i18n/(.*?)"[\s\S]*?<td class="time">(.*?)</td>`)
-		var newLanFileTime int64
-		for _, val := range re.FindAllStringSubmatch(j, -1) {
-			if fmt.Sprintf("%s.toml", locLanguage) == val[1] {
-				t, _ := time.Parse(time.RFC1123, val[2])
-				newLanFileTime = t.Unix()
-			}
+		return "", err
+	}
+	defer httpLocal.DrainBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download %s.toml: %s", locLanguage, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// 先确认下载的内容可以解析并且与程序匹配，避免把错误页面或其他版本的语言文件当作语言文件保存
+	name := fmt.Sprintf("%s.toml", locLanguage)
+	if _, err = parseCatalog(data, name); err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, name)
+	return target, ioutil.WriteFile(target, data, 0644)
+}
 
+// detectLanguage returns the language of the environment from LC_ALL,
+// LC_MESSAGES or LANG, such as zh-CN for zh_CN.UTF-8, and en when none is set
+func detectLanguage() string {
+	for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		value := os.Getenv(key)
+		if value == "" {
+			continue
 		}
-		oldLanFileTime := GetFileModTime(dir)
-		if newLanFileTime > oldLanFileTime {
-			err = os.RemoveAll(dir)
-			dropErr(err)
-			resp, err := http.Get(fmt.Sprintf("https://cdn.jsdelivr.net/gh/gaowanliang/OneDriveUploader/i18n/%s.toml", locLanguage))
-			dropErr(err)
-			defer resp.Body.Close()
-			data, err := ioutil.ReadAll(resp.Body)
-			dropErr(err)
-			ioutil.WriteFile(dir, data, 0644)
+		// zh_CN.UTF-8@latin -> zh-CN
+		value = strings.SplitN(value, ".", 2)[0]
+		value = strings.SplitN(value, "@", 2)[0]
+		if value == "C" || value == "POSIX" {
+			return "en"
+		}
+		tag, err := language.Parse(strings.ReplaceAll(value, "_", "-"))
+		if err == nil {
+			return tag.String()
 		}
 	}
-	dir, err = os.Executable()
-	// log.Println(dir)
-	dropErr(err)
-	dir = filepath.Dir(dir)
-	rd, err := ioutil.ReadDir(dir)
-	if err != nil {
-		log.Panic(err)
-	}
-	for _, fi := range rd {
-		if !fi.IsDir() && path.Ext(fi.Name()) == ".toml" {
-			// log.Println(path.Join(dir, fi.Name()))
-			bundle.LoadMessageFile(path.Join(dir, fi.Name()))
+	return "en"
+}
+
+// argLanguage returns the value of -l before the flags are parsed, so the flag
+// usage text can already be localized. It falls back to the environment.
+func argLanguage(args []string) string {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == "l" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "l=") {
+			return strings.TrimPrefix(name, "l=")
 		}
 	}
-	loc.localize = i18n.NewLocalizer(bundle, locLanguage)
+	return detectLanguage()
 }
+
+type Loc struct {
+	localize *i18n.Localizer
+}
+
+func (loc *Loc) init(locLanguage string) {
+	loc.localize = i18n.NewLocalizer(bundle, locLanguage, "en")
+}
+
+// print returns the message tag in the current language. Messages missing in
+// that language fall back to English, unknown tags are returned as they are.
 func (loc *Loc) print(tag string) string {
-	return loc.localize.MustLocalize(&i18n.LocalizeConfig{MessageID: tag})
+	msg, err := loc.localize.Localize(&i18n.LocalizeConfig{MessageID: tag})
+	if msg == "" && err != nil {
+		return tag
+	}
+	return msg
+}
+
+// printN returns the plural form of tag matching count, the count is
+// available to the message as {{.Count}}
+func (loc *Loc) printN(tag string, count int) string {
+	msg, err := loc.localize.Localize(&i18n.LocalizeConfig{
+		MessageID:    tag,
+		PluralCount:  count,
+		TemplateData: map[string]interface{}{"Count": count},
+	})
+	if msg == "" && err != nil {
+		return fmt.Sprintf("%s: %d", tag, count)
+	}
+	return msg
 }
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,14 +13,18 @@ import (
 	"main/fileutil"
 	"main/googledrive"
 	httpLocal "main/graph/net/http"
+	"main/notify"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/buger/jsonparser"
@@ -34,7 +40,10 @@ func ApplyForNewPass(url string, ms int) string {
 	return httpLocal.NewPassCheck(url, ms, lang)
 }
 
-func Upload(infoPath string, filePath string, targetFolder string, threads int, sendMsg func() (func(text string), string, string), locText func(text string) string) {
+// Upload uploads filePath to OneDrive. Cancelling ctx stops starting new files
+// and checkpoints the large files in flight, the returned counts are the
+// completed and the unfinished files.
+func Upload(ctx context.Context, infoPath string, filePath string, targetFolder string, threads int, stats *fileutil.ScanStats, locText func(text string) string) (int, int) {
 
 	programPath, err := filepath.Abs(filepath.Dir(infoPath))
 	if err != nil {
@@ -59,13 +68,86 @@ func Upload(infoPath string, filePath string, targetFolder string, threads int,
 	}
 	filePath = path.Base(filePath)
 	//Initialize the upload restore service
-	restoreSrvc := upload.GetRestoreService(&http.Client{Timeout: time.Duration(fileutil.GetTimeOut()) * time.Second})
-
-	//Get the list of files that needs to be restore with the actual backed up path. 获取需要使用实际备份路径还原的文件列表。
-	fileInfoToUpload, err := fileutil.GetAllUploadItemsFrmSource(filePath)
+	restoreSrvc := upload.GetRestoreService(&http.Client{
+		Transport: httpLocal.NewStallTransport(httpLocal.Transport(), time.Duration(fileutil.GetTimeOut())*time.Second, int64(fileutil.GetMinSpeed())*1024),
+	})
+	// 被中断的大文件上传会话保存在配置文件旁边，下次运行时继续
+	restoreSrvc.Resume = fileutil.LoadResumeState(resumePath(infoPath))
+	// 已上传文件的索引同样保存在配置文件旁边，没有变化的文件不再上传
+	index, err := loadIndex(infoPath)
 	if err != nil {
-		log.Fatalf(loc.print("failToLoadFiles"), err)
+		log.Panic(err)
 	}
+	defer func() {
+		if err := index.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if sanitizeNames && fileutil.DryRun() {
+		fileutil.SetSanitize(true, nil)
+	} else if sanitizeNames {
+		// 被替换的文件名记录在配置文件旁边，下载时可以据此还原
+		mapping, err := fileutil.LoadNameMapping(namesPath(infoPath))
+		if err != nil {
+			log.Panic(err)
+		}
+		fileutil.SetSanitize(true, mapping)
+		defer mapping.Close()
+	}
+	links := setSymlinks(infoPath, func(p string) string {
+		return fileutil.RemotePath(filepath.Join(targetFolder, p))
+	})
+	defer links.Close()
+
+	// OneDrive 不区分大小写并且会统一 Unicode 形式，会互相覆盖的文件在扫描时处理；
+	// -collision abort 需要在上传任何文件之前找出所有冲突
+	if collision == "abort" {
+		if err := checkCollisions(filePath, targetFolder); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	resolver := newCollisionResolver(targetFolder)
+
+	// 先建好目标文件夹，扫描到的文件夹在其中的文件之前创建，包括空文件夹
+	// 试运行时只检查文件夹是否存在，不存在的记入计划
+	planFolder := func(remotePath string) {
+		userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
+		if _, found, err := restoreSrvc.GetItem(ctx, userID, bearerToken, remotePath); err != nil || !found {
+			fileutil.PlanFolder(remotePath)
+		}
+	}
+	userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
+	if fileutil.DryRun() {
+		planFolder(fileutil.RemotePath(targetFolder))
+	} else if err := restoreSrvc.CreateFolders(ctx, userID, bearerToken, []string{targetFolder}, threads); err != nil && ctx.Err() == nil {
+		log.Printf(loc.print("createFolderFail"), err)
+	}
+	createFolder := func(dir string) error {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if fileutil.DryRun() {
+			planFolder(fileutil.RemotePath(filepath.Join(targetFolder, dir)))
+			return nil
+		}
+		userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
+		if err := restoreSrvc.CreateFolder(ctx, userID, bearerToken, fileutil.RemotePath(filepath.Join(targetFolder, dir))); err != nil && ctx.Err() == nil {
+			log.Printf(loc.print("createFolderFail"), err)
+		}
+		return nil
+	}
+
+	// 无法读取的文件夹记为失败，扫描继续，只有上传的文件夹本身无法读取时才退出
+	fileutil.SetUnreadable(func(p string, err error) {
+		fileutil.RecordResult(fileutil.FileResult{Path: p, RemotePath: fileutil.RemotePath(filepath.Join(targetFolder, p)), Status: "failed", Reason: "read", Error: err.Error()})
+	})
+
+	// 扫描和上传同时进行，队列满时扫描暂停，文件在开始上传时才打开
+	fileInfoToUpload := make(chan fileutil.FileInfo, threads)
+	scanDone := make(chan error, 1)
+	go func() {
+		scanDone <- fileutil.ScanUploadItems(filePath, createFolder, resolver.resolve, fileInfoToUpload, stats)
+	}()
 
 	//Call restore process based on alternate or original location 基于备用或原始位置调用还原过程
 	/*if restoreOption == "alt" {
@@ -74,85 +156,398 @@ func Upload(infoPath string, filePath string, targetFolder string, threads int,
 		restore(restoreSrvc, fileInfoToUpload, threads)
 	}*/
 
-	restore(restoreSrvc, fileInfoToUpload, targetFolder, threads, sendMsg, locText, infoPath)
+	completed, unfinished := restore(ctx, restoreSrvc, index, fileInfoToUpload, targetFolder, threads, locText, infoPath)
+	if err := <-scanDone; err != nil {
+		log.Fatalf(loc.print("failToLoadFiles"), err)
+	}
+	if fileutil.AfterUpload() && !fileutil.DryRun() {
+		// 文件删除或移走后留下的空文件夹一并删除
+		fileutil.RemoveEmptyDirs(filePath)
+	}
 	err = os.Chdir(oldDir)
 	if err != nil {
 		log.Panic(err)
 	}
+	return completed, unfinished
+}
+
+// resumePath returns where the resume state of the config file infoPath is saved
+func resumePath(infoPath string) string {
+	return strings.TrimSuffix(infoPath, ".json") + ".resume.json"
+}
+
+// indexPath returns where the upload index of the config file infoPath is saved
+func indexPath(infoPath string) string {
+	return strings.TrimSuffix(infoPath, ".json") + ".index.jsonl"
+}
+
+// loadIndex opens the upload index of the config file infoPath, the dry run
+// only reads it
+func loadIndex(infoPath string) (*fileutil.Index, error) {
+	if fileutil.DryRun() {
+		return fileutil.ReadIndex(indexPath(infoPath)), nil
+	}
+	return fileutil.LoadIndex(indexPath(infoPath))
+}
+
+// namesPath returns where the sanitized names of the config file infoPath are recorded
+func namesPath(infoPath string) string {
+	return strings.TrimSuffix(infoPath, ".json") + ".names.jsonl"
+}
+
+// linksPath returns where -symlinks record saves the link targets of the config file infoPath
+func linksPath(infoPath string) string {
+	return strings.TrimSuffix(infoPath, ".json") + ".links.jsonl"
+}
+
+// setSymlinks makes the scan handle symlinks as -symlinks says and logs every
+// link that is not followed once. With -symlinks record the link targets are
+// saved next to the config file infoPath under the remote path of the link,
+// the returned record has to be closed after the upload.
+func setSymlinks(infoPath string, remote func(p string) string) *fileutil.NameMapping {
+	var links *fileutil.NameMapping
+	if symlinks == "record" && !fileutil.DryRun() {
+		var err error
+		if links, err = fileutil.LoadLinkRecord(linksPath(infoPath)); err != nil {
+			log.Panic(err)
+		}
+	}
+	var mutex sync.Mutex
+	reported := make(map[string]bool)
+	fileutil.SetSymlinks(symlinks, func(p string, target string, action string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// -collision abort 会先扫描一次，同一个链接只处理一次
+		if reported[p] {
+			return
+		}
+		reported[p] = true
+		switch action {
+		case "record":
+			if err := links.Record(remote(p), target); err != nil {
+				log.Println(err)
+			}
+			log.Printf(loc.print("symlinkRecord"), p, target)
+		case "skip":
+			log.Printf(loc.print("symlinkSkip"), p, target)
+		case "broken":
+			log.Printf(loc.print("symlinkBroken"), p, target)
+		case "loop":
+			log.Printf(loc.print("symlinkLoop"), p, target)
+		}
+	})
+	return links
 }
 func changeBlockSize(MB int) {
 	fileutil.SetDefaultChunkSize(MB)
 }
 
 //Restore to original location
-func restore(restoreSrvc *upload.RestoreService, filesToRestore map[string]fileutil.FileInfo, targetFolder string, threads int, sendMsg func() (func(text string), string, string), locText func(text string) string, infoPath string) {
+func restore(ctx context.Context, restoreSrvc *upload.RestoreService, index *fileutil.Index, filesToRestore <-chan fileutil.FileInfo, targetFolder string, threads int, locText func(text string) string, infoPath string) (int, int) {
+	var completed, unfinished int64
 	var wg sync.WaitGroup
 	pool := make(chan struct{}, threads)
 	checkPath := make(map[string]bool, 0)
-	pathFiles := make(map[string]map[string]bool, 0)
+	pathFiles := make(map[string]map[string]upload.DriveItem, 0)
+	username := strings.ReplaceAll(filepath.Base(infoPath), ".json", "")
+	if rescanRemote {
+		// 重新从网盘建立索引，网盘中大小一致的文件记入索引并跳过
+		index.Reset("OneDrive", username)
+	}
 
-	filePaths := make([]string, 0, len(filesToRestore))
-	for k := range filesToRestore {
-		filePaths = append(filePaths, k)
+	// 每个文件的结果记录下来，用于运行结束后的摘要和报告
+	recordResult := func(filePath string, size int64, status string, reason string) {
+		remotePath := fileutil.RemotePath(filepath.Join(targetFolder, filePath))
+		fileutil.RecordResult(fileutil.FileResult{Path: filePath, RemotePath: remotePath, Status: status, Reason: reason, Size: size})
 	}
-	sort.Sort(sort.StringSlice(filePaths)) //将文件按照文件名顺序排序
-	for _, filePath := range filePaths {
-		wg.Add(1)
-		pool <- struct{}{}
-		fileInfo := filesToRestore[filePath]
-		paths, fileName := filepath.Split(filepath.Join(targetFolder, filePath))
-		if mode == 1 {
-			if paths == "" {
-				paths = "/"
-			}
-			paths = strings.ReplaceAll(paths, "\\", "/")
-			if paths[len(paths)-1] == '/' {
-				paths = paths[:len(paths)-1]
+
+	// 上传过程中发生变化的文件在这一轮结束后重新排队，最多 maxRequeue 轮
+	// replaced 是已经上传过的文件在网盘中创建的项目，其中是本次运行上传的旧内容
+	var requeueMutex sync.Mutex
+	replaced := make(map[string]upload.DriveItem)
+	for round := 0; filesToRestore != nil; round++ {
+		requeued := make(map[string]fileutil.FileInfo)
+		requeue := func(filePath string, fileInfo fileutil.FileInfo, created upload.DriveItem) {
+			if round == maxRequeue {
+				// 一直在变化的文件记为失败，unfinished 只统计因中断没有上传的文件
+				recordResult(filePath, fileInfo.Size, "failed", "unstable")
+				return
 			}
-			if _, ok := checkPath[paths]; !ok {
-				userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
-				files, _ := restoreSrvc.GetDriveItem(userID, bearerToken, paths)
-				checkPath[paths] = true
-				pathFiles[paths] = files
+			notify.Publish(notify.Retrying{Path: filePath, Reason: "changed", Attempt: round + 1})
+			// 文件在下一轮上传时重新打开
+			fileInfo.FileData = nil
+			requeueMutex.Lock()
+			requeued[filePath] = fileInfo
+			if created.ID != "" {
+				replaced[filePath] = created
 			}
-			// log.Println(checkPath, paths, pathFiles, fileName, filePath)
+			requeueMutex.Unlock()
 		}
 
-		go func(filePath string, fileInfo fileutil.FileInfo) {
-			defer wg.Done()
-			defer func() {
+		// 扫描按文件名顺序进行，文件依次派发给空闲的线程
+		for fileInfo := range filesToRestore {
+			filePath := fileInfo.Path
+			pool <- struct{}{}
+			if ctx.Err() != nil {
+				// 收到中断信号后不再派发新的文件
 				<-pool
-			}()
-			temps, _botKey, iUserID := sendMsg()
-			var iSendMsg func(string)
-			tip := "`" + filePath + "`" + loc.print("startToUpload1")
-			if _botKey != "" && iUserID != "" {
-				iSendMsg = botSend(_botKey, iUserID, tip)
+				atomic.AddInt64(&unfinished, 1)
+				recordResult(filePath, fileInfo.Size, "unfinished", "interrupted")
+				continue
 			}
-			temp := func(text string) {
-				temps(text)
-				if _botKey != "" && iUserID != "" {
-					iSendMsg(text)
+			remotePath := fileutil.RemotePath(filepath.Join(targetFolder, filePath))
+			paths, fileName := path.Split(remotePath)
+			policy := conflictPolicy(filePath)
+			// 试运行需要知道每个文件在网盘中是否已经存在
+			if conflictPolicies[policy] || fileutil.DryRun() {
+				if paths == "" {
+					paths = "/"
 				}
-			}
-			if _, ok := pathFiles[paths][fileName]; !ok || mode == 0 {
-				temp(tip)
-				userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, _botKey, _UserID)
-				username := strings.ReplaceAll(filepath.Base(infoPath), ".json", "")
-				restoreSrvc.SimpleUploadToOriginalLoc(userID, bearerToken, "replace", targetFolder, filePath, fileInfo, temp, locText, username)
-			} else {
-				tip = filePath + "已存在，自动跳过"
-				if _botKey != "" && iUserID != "" {
-					iSendMsg = botSend(_botKey, iUserID, tip)
+				paths = strings.ReplaceAll(paths, "\\", "/")
+				if paths[len(paths)-1] == '/' {
+					paths = paths[:len(paths)-1]
+				}
+				if _, ok := checkPath[paths]; !ok {
+					userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
+					files, err := restoreSrvc.GetDriveItem(ctx, userID, bearerToken, paths)
+					if err != nil {
+						// 不知道网盘中是否已有同名文件时不上传，也不缓存结果，同一目录的下一个文件重新获取
+						<-pool
+						if ctx.Err() != nil {
+							atomic.AddInt64(&unfinished, 1)
+							recordResult(filePath, fileInfo.Size, "unfinished", "interrupted")
+						} else {
+							fileutil.RecordResult(fileutil.FileResult{Path: filePath, RemotePath: remotePath, Status: "failed", Reason: "list", Error: err.Error(), Size: fileInfo.Size})
+						}
+						continue
+					}
+					checkPath[paths] = true
+					pathFiles[paths] = files
 				}
-				temp(tip)
-				time.Sleep(time.Second * 3)
+				// log.Println(checkPath, paths, pathFiles, fileName, filePath)
 			}
-			defer temp("close=")
-		}(filePath, fileInfo)
+			// 网盘中的同名文件在派发时查好，线程中不再读取 pathFiles
+			item, exists := pathFiles[paths][fileName]
+			requeueMutex.Lock()
+			replace, reupload := replaced[filePath]
+			requeueMutex.Unlock()
+
+			wg.Add(1)
+			go func(filePath string, fileInfo fileutil.FileInfo, item upload.DriveItem, exists bool) {
+				defer wg.Done()
+				defer func() {
+					<-pool
+				}()
+				// 试运行不等待也不打开文件
+				if !fileutil.DryRun() {
+					// 仍在写入的文件等到写完再上传，扫描后被删除的文件跳过
+					if err := fileutil.WaitStable(&fileInfo); err == fileutil.ErrVanished {
+						atomic.AddInt64(&completed, 1)
+						recordResult(filePath, fileInfo.Size, "skipped", "vanished")
+						return
+					} else if err == fileutil.ErrChanged {
+						requeue(filePath, fileInfo, upload.DriveItem{})
+						return
+					} else if err != nil {
+						// 无法读取的文件记为失败，不影响其他文件
+						fileutil.RecordResult(fileutil.FileResult{Path: filePath, RemotePath: remotePath, Status: "failed", Reason: "read", Error: err.Error(), Size: fileInfo.Size})
+						return
+					}
+					if err := fileInfo.Open(); err == fileutil.ErrVanished {
+						atomic.AddInt64(&completed, 1)
+						recordResult(filePath, fileInfo.Size, "skipped", "vanished")
+						return
+					} else if err != nil {
+						fileutil.RecordResult(fileutil.FileResult{Path: filePath, RemotePath: remotePath, Status: "failed", Reason: "read", Error: err.Error(), Size: fileInfo.Size})
+						return
+					}
+					defer fileInfo.Close()
+				}
+				entry := fileutil.IndexEntry{Path: remotePath, Size: fileInfo.Size, ModTime: fileInfo.ModTime.Unix(), Backend: "OneDrive", Account: username}
+				indexed := index.Unchanged(entry.Backend, entry.Account, entry.Path, entry.Size, entry.ModTime)
+				if !indexed && rescanRemote {
+					userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
+					item, found, err := restoreSrvc.GetItem(ctx, userID, bearerToken, remotePath)
+					if err == nil && found {
+						indexed = remoteMatches(item, filePath, entry, index)
+					}
+				}
+				// 根据冲突策略决定跳过、覆盖还是交给 Graph 处理
+				// skip 只有网盘中的文件符合 -skip 策略时才跳过，半途中断的同名文件会重新上传
+				// 上一轮已经上传过的文件覆盖它上传时创建的项目，rename 时就是改名后的文件，
+				// 网盘中原有的同名文件不受影响；上传前就在变化而重新排队的文件没有上传过，仍然按冲突策略处理
+				conflictOption, ifMatch, skipReason := "replace", "", ""
+				if !indexed && !reupload {
+					switch policy {
+					case "skip":
+						if exists && remoteMatches(item, filePath, entry, index) {
+							skipReason = "exists"
+						}
+					case "newer":
+						if exists && !fileInfo.ModTime.After(item.ModTime()) {
+							skipReason = "newer"
+						}
+					case "larger":
+						if exists && entry.Size <= item.Size {
+							skipReason = "larger"
+						}
+					case "ifmatch":
+						// 网盘中的文件在本次运行中被修改时 eTag 不再匹配，上传会被拒绝；
+						// 原本不存在的文件如果期间被创建，同样不会被覆盖
+						if exists {
+							ifMatch = item.ETag
+						} else {
+							conflictOption = "fail"
+						}
+					case "rename", "fail":
+						conflictOption = policy
+					}
+				}
+				if fileutil.DryRun() {
+					atomic.AddInt64(&completed, 1)
+					action, reason := plannedAction(indexed, skipReason, conflictOption, exists)
+					fileutil.PlanFile(fileutil.PlannedFile{Path: filePath, RemotePath: remotePath, Action: action, Reason: reason, Size: fileInfo.Size})
+				} else if indexed {
+					atomic.AddInt64(&completed, 1)
+					recordResult(filePath, fileInfo.Size, "skipped", "index")
+					if fileutil.AfterUpload() {
+						// 索引只说明以前上传过，删除或移走本地文件前确认网盘中的文件仍然存在并且相同
+						userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
+						remote, found, err := restoreSrvc.GetItem(ctx, userID, bearerToken, remotePath)
+						if err == nil && (!found || remote.File == nil) {
+							err = fileutil.ErrNotOnDrive
+						}
+						if err != nil {
+							notify.Publish(notify.SourceKept{Path: filePath, Err: err})
+						} else {
+							remoteHashType, remoteHash := remote.Hash()
+							finishSource(filePath, &fileInfo, remote.Size, remoteHashType, remoteHash)
+						}
+					}
+				} else if skipReason == "" {
+					notify.Publish(notify.FileStarted{Path: filePath, RemotePath: remotePath, Size: fileInfo.Size})
+					started := time.Now()
+					userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
+					resp, err := restoreSrvc.SimpleUploadToOriginalLoc(ctx, userID, bearerToken, conflictOption, ifMatch, replace.ID, targetFolder, filePath, fileInfo, locText)
+					// 大文件上传中途发现改写时会放弃上传，网盘中没有这个文件的内容
+					var created upload.DriveItem
+					if err == nil {
+						created, _ = upload.ItemFromResponse(resp)
+						// 上传期间文件被改写时，网盘中的内容已经过时
+						if _, changed, statErr := fileInfo.Changed(); changed {
+							err = fileutil.ErrChanged
+						} else if statErr == fileutil.ErrVanished {
+							err = statErr
+						}
+					}
+					if err == httpLocal.ErrInterrupted {
+						atomic.AddInt64(&unfinished, 1)
+						recordResult(filePath, fileInfo.Size, "unfinished", "interrupted")
+					} else if errors.Is(err, fileutil.ErrChanged) {
+						requeue(filePath, fileInfo, created)
+					} else if err == fileutil.ErrVanished {
+						atomic.AddInt64(&completed, 1)
+						recordResult(filePath, fileInfo.Size, "skipped", "vanished")
+					} else if httpLocal.IsConflict(err) {
+						// eTag 不匹配说明网盘中的文件在本次运行中被修改过
+						atomic.AddInt64(&completed, 1)
+						if ifMatch != "" {
+							recordResult(filePath, fileInfo.Size, "skipped", "etag")
+						} else {
+							recordResult(filePath, fileInfo.Size, "skipped", "conflict")
+						}
+					} else if err != nil {
+						fileutil.RecordResult(fileutil.FileResult{Path: filePath, RemotePath: remotePath, Status: "failed", Reason: "upload", Error: err.Error(), Size: fileInfo.Size})
+					} else {
+						atomic.AddInt64(&completed, 1)
+						result := fileutil.FileResult{Path: filePath, RemotePath: remotePath, Status: "uploaded", Size: fileInfo.Size, Elapsed: time.Since(started)}
+						item, ok := upload.ItemFromResponse(resp)
+						result.ItemID, result.WebURL = item.ID, item.WebURL
+						if item.Name != "" {
+							// rename 时记录网盘中实际的文件名
+							result.RemotePath = path.Join(path.Dir(remotePath), item.Name)
+						}
+						fileutil.RecordResult(result)
+						if ok {
+							entry.ItemID = item.ID
+							entry.HashType, entry.Hash = item.Hash()
+							if err := index.Add(entry); err != nil {
+								log.Println(err)
+							}
+							finishSource(filePath, &fileInfo, item.Size, entry.HashType, entry.Hash)
+						} else if fileutil.AfterUpload() {
+							notify.Publish(notify.SourceKept{Path: filePath, Err: fileutil.ErrNotVerified})
+						}
+					}
+				} else {
+					atomic.AddInt64(&completed, 1)
+					recordResult(filePath, fileInfo.Size, "skipped", skipReason)
+					if skipReason == "exists" {
+						// 网盘中已经有同样的文件，本地文件同样可以删除或移走
+						itemHashType, itemHash := item.Hash()
+						finishSource(filePath, &fileInfo, item.Size, itemHashType, itemHash)
+					}
+				}
+			}(filePath, fileInfo, item, exists)
+		}
+		wg.Wait()
+		filesToRestore = nil
+		if len(requeued) > 0 {
+			filesToRestore = queueFiles(requeued)
+		}
+	}
+	if fileutil.DryRun() {
+		return int(completed), int(atomic.LoadInt64(&unfinished))
+	}
+	if err := restoreSrvc.Resume.Save(); err != nil {
+		log.Println(err)
+	}
+	return int(completed), int(atomic.LoadInt64(&unfinished))
+}
+
+// finishSource deletes or moves the uploaded local file as -delete-after and
+// -move-after say, size and hash are those of the file on the drive
+func finishSource(filePath string, fileInfo *fileutil.FileInfo, size int64, hashType string, hash string) {
+	if !fileutil.AfterUpload() {
+		return
+	}
+	fileInfo.Close()
+	if err := fileutil.FinishSource(filePath, filePath, size, hashType, hash); err != nil {
+		notify.Publish(notify.SourceKept{Path: filePath, Err: err})
+	}
+}
+
+// queueFiles returns a closed queue holding files sorted by path
+func queueFiles(files map[string]fileutil.FileInfo) <-chan fileutil.FileInfo {
+	filePaths := make([]string, 0, len(files))
+	for k := range files {
+		filePaths = append(filePaths, k)
+	}
+	sort.Strings(filePaths)
+	queue := make(chan fileutil.FileInfo, len(filePaths))
+	for _, filePath := range filePaths {
+		queue <- files[filePath]
 	}
-	wg.Wait()
+	close(queue)
+	return queue
+}
 
+// remoteMatches reports whether item is the same file as the local filePath
+// under the -skip policy, a matching file is recorded in the index
+func remoteMatches(item upload.DriveItem, filePath string, entry fileutil.IndexEntry, index *fileutil.Index) bool {
+	ok, err := item.Matches(skipPolicy, filePath, entry.Size)
+	if err != nil {
+		log.Println(err)
+	}
+	if !ok {
+		return false
+	}
+	entry.ItemID = item.ID
+	entry.HashType, entry.Hash = item.Hash()
+	if err := index.Add(entry); err != nil {
+		log.Println(err)
+	}
+	return true
 }
 
 func printResp(resp interface{}) {
@@ -168,7 +563,7 @@ func printResp(resp interface{}) {
 }
 
 //Restore to Alternate location 还原到备用位置
-func restoreToAltLoc(restoreSrvc *upload.RestoreService, filesToRestore map[string]fileutil.FileInfo, targetFolder string, sendMsg func() func(text string), locText func(text string) string, infoPath string) {
+func restoreToAltLoc(restoreSrvc *upload.RestoreService, filesToRestore map[string]fileutil.FileInfo, targetFolder string, locText func(text string) string, infoPath string) {
 	rootFolder := fileutil.GetAlternateRootFolder()
 	var wg sync.WaitGroup
 	pool := make(chan struct{}, 10)
@@ -181,12 +576,10 @@ func restoreToAltLoc(restoreSrvc *upload.RestoreService, filesToRestore map[stri
 			defer func() {
 				<-pool
 			}()
-			temp := sendMsg()
-			temp(filePath + loc.print("startToUpload1"))
-			us := ""
+			notify.Publish(notify.FileStarted{Path: filePath, RemotePath: rootFilePath, Size: fileItem.Size})
 			userID, bearerToken := httpLocal.GetMyIDAndBearer(infoPath, thread, block, lang, timeOut, botKey, _UserID)
 			//username := strings.ReplaceAll(filepath.Base(infoPath), ".json", "")
-			restoreSrvc.SimpleUploadToAlternateLoc(userID, bearerToken, "rename", targetFolder, rootFilePath, fileItem, temp, locText, us)
+			restoreSrvc.SimpleUploadToAlternateLoc(context.Background(), userID, bearerToken, "rename", targetFolder, rootFilePath, fileItem, locText)
 
 		}()
 		wg.Wait()
@@ -198,77 +591,94 @@ func oldFunc(a string) string {
 	return a
 }
 
-func botSend(botKey string, iuserID string, initText string) func(string) {
-	var messageId = int64(0)
-	resp, err := http.Get(fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage?chat_id=%s&parse_mode=MarkdownV2&text=%s", botKey, iuserID, url.QueryEscape(initText)))
+// telegramTimeout 是每个 Telegram 请求的超时时间，Telegram 无法访问时不会一直等待
+const telegramTimeout = 30 * time.Second
+
+// telegramClient 是 Telegram 通知共用的 client，复用连接
+// 在读取配置后按配置中的代理等设置重新创建
+var telegramClient = &http.Client{Timeout: telegramTimeout}
+
+// telegramMessage 是发送到 Telegram 的一条消息，之后可以修改或删除
+type telegramMessage struct {
+	botKey string
+	userID string
+	id     int64
+}
+
+// sendTelegram sends text to the chat of userID, the returned message edits
+// and deletes it
+func sendTelegram(botKey string, userID string, text string) *telegramMessage {
+	message := &telegramMessage{botKey: botKey, userID: userID}
+	resp, err := telegramClient.Get(fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage?chat_id=%s&parse_mode=MarkdownV2&text=%s", botKey, userID, url.QueryEscape(text)))
 	if err != nil {
 		log.Println(err)
+		return message
 	}
-	defer resp.Body.Close()
+	defer httpLocal.DrainBody(resp)
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Panic(err)
+		log.Println(err)
+		return message
 	}
 	//fmt.Println(string(body))
 	ok, _ := jsonparser.GetBoolean(body, "ok")
 	if ok {
-		messageId, _ = jsonparser.GetInt(body, "result", "message_id")
+		message.id, _ = jsonparser.GetInt(body, "result", "message_id")
 	} else {
 		description, _ := jsonparser.GetString(body, "description")
 		log.Println(loc.print("telegramSendError"), description)
 	}
-	return func(text string) {
-		if text[:5] == "close" && text[5] != '|' {
-			// msg 头部的 close 用作输出时定位，带有 close 在输出时不会被刷新走
-			// close= 表示文件传输结束，此时会同步删除tg发出的消息
-			// close| 则不会删除消息
-			resp, err = http.Get(fmt.Sprintf("https://api.telegram.org/bot%s/deleteMessage?chat_id=%s&message_id=%d", botKey, iuserID, messageId))
-			if err != nil {
-				log.Println(err)
-			}
-			defer resp.Body.Close()
-			return
-		}
-		resp, err = http.Get(fmt.Sprintf("https://api.telegram.org/bot%s/editMessageText?chat_id=%s&parse_mode=MarkdownV2&message_id=%d&text=%s", botKey, iuserID, messageId, url.QueryEscape(text)))
-		if err != nil {
-			log.Println(err)
-		}
-		defer resp.Body.Close()
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Println(err)
-		}
-		//fmt.Println(string(body))
-		ok, _ = jsonparser.GetBoolean(body, "ok")
-		if !ok {
-			description, _ := jsonparser.GetString(body, "description")
-			if !strings.Contains(string(body), "message is not modified") && !strings.Contains(string(body), "Too Many Requests") {
-				log.Println(loc.print("telegramSendError"), description)
-			}
-		}
+	return message
+}
 
+// edit replaces the text of the message
+func (m *telegramMessage) edit(text string) {
+	resp, err := telegramClient.Get(fmt.Sprintf("https://api.telegram.org/bot%s/editMessageText?chat_id=%s&parse_mode=MarkdownV2&message_id=%d&text=%s", m.botKey, m.userID, m.id, url.QueryEscape(text)))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer httpLocal.DrainBody(resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println(err)
+	}
+	//fmt.Println(string(body))
+	ok, _ := jsonparser.GetBoolean(body, "ok")
+	if !ok {
+		description, _ := jsonparser.GetString(body, "description")
+		if !strings.Contains(string(body), "message is not modified") && !strings.Contains(string(body), "Too Many Requests") {
+			log.Println(loc.print("telegramSendError"), description)
+		}
 	}
 }
 
-func DirSize(path string) (int64, error) {
-	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-
-		if info != nil && !info.IsDir() {
-			size += info.Size()
-		}
-		return err
-	})
-	return size, err
+// delete removes the message from the chat
+func (m *telegramMessage) delete() {
+	resp, err := telegramClient.Get(fmt.Sprintf("https://api.telegram.org/bot%s/deleteMessage?chat_id=%s&message_id=%d", m.botKey, m.userID, m.id))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	httpLocal.DrainBody(resp)
 }
 
 var timeOut int
+var minSpeed int
 var lang string
 var block int
 var botKey string
 var _UserID string
 var thread int
-var mode int
+var mode string
+var rescanRemote bool
+var skipPolicy string
+var sanitizeNames bool
+var collision string
+var symlinks string
+
+// maxRequeue 是上传过程中发生变化的文件最多重新排队的次数
+const maxRequeue = 3
 
 func main() {
 	var codeURL string
@@ -276,25 +686,154 @@ func main() {
 	var folder string
 	var ms int
 	var targetFolder string
+	var proxy, telegramProxy, caBundle, localAddr string
+	var updateLang bool
 
 	// StringVar用指定的名称、控制台参数项目、默认值、使用信息注册一个string类型flag，并将flag的值保存到p指向的变量
 
-	flag.StringVar(&codeURL, "a", "", "Please refer to \"https://github.com/gaowanliang/LightUploader/wiki\"")
-	flag.IntVar(&ms, "v", 0, "Select the version, where 0 is the business version, 1 is the personal version (home version), 2 is 21vianet (CN) version, 3 is Google Drive. The default is 0")
-	flag.StringVar(&configFile, "c", "", "Authorize config file location")
-	flag.StringVar(&folder, "f", "", "Files / folders to upload")
-	flag.IntVar(&thread, "t", 3, "The number of threads")
-	flag.IntVar(&block, "b", 10, "User defined upload block size can improve network throughput. Limited by disk performance and network speed, the default is 10 (unit: MB)")
-	flag.StringVar(&botKey, "tgbot", "", "Use the telegram robot to monitor the upload in real time. Here you need to fill in the robot's access token, such as 123456789:XXXXXXXX, and use double quotation marks when entering")
-	flag.StringVar(&_UserID, "uid", "", "Use the telegram robot to monitor the upload in real time. Fill in the user ID of the receiver, such as 123456789")
-	flag.StringVar(&targetFolder, "r", "", "Set the directory you want to upload to onedrive")
-	flag.IntVar(&timeOut, "to", 60, "When uploading, the timeout of each block is 60s by default")
-	flag.IntVar(&mode, "m", 0, "Select the mode, 0 is to replace the file with the same name in onedrive, 1 is to skip, the default is 0")
-	flag.StringVar(&lang, "l", "en", "Set the software language, English by default")
+	// 参数说明在解析参数之前就需要翻译，这里先根据 -l 或环境变量选择语言
+	loc = Loc{}
+	loc.init(argLanguage(os.Args[1:]))
+
+	flag.StringVar(&codeURL, "a", "", loc.print("flagA"))
+	flag.IntVar(&ms, "v", 0, loc.print("flagV"))
+	flag.StringVar(&configFile, "c", "", loc.print("flagC"))
+	flag.StringVar(&folder, "f", "", loc.print("flagF"))
+	flag.IntVar(&thread, "t", 3, loc.print("flagT"))
+	flag.IntVar(&block, "b", 10, loc.print("flagB"))
+	flag.StringVar(&botKey, "tgbot", "", loc.print("flagTgbot"))
+	flag.StringVar(&_UserID, "uid", "", loc.print("flagUid"))
+	flag.StringVar(&targetFolder, "r", "", loc.print("flagR"))
+	flag.IntVar(&timeOut, "to", 60, loc.print("flagTo"))
+	flag.IntVar(&minSpeed, "speed", 32, loc.print("flagSpeed"))
+	flag.StringVar(&mode, "m", "replace", loc.print("flagM"))
+	var rules ruleFlags
+	flag.Var(&rules, "rule", loc.print("flagRule"))
+	flag.StringVar(&lang, "l", "", loc.print("flagL"))
+	flag.BoolVar(&updateLang, "update-lang", false, loc.print("flagUpdateLang"))
+	flag.StringVar(&proxy, "proxy", "", loc.print("flagProxy"))
+	flag.StringVar(&telegramProxy, "tgproxy", "", loc.print("flagTgproxy"))
+	flag.StringVar(&caBundle, "cacert", "", loc.print("flagCacert"))
+	flag.StringVar(&localAddr, "bind", "", loc.print("flagBind"))
+	flag.BoolVar(&rescanRemote, "rescan-remote", false, loc.print("flagRescanRemote"))
+	flag.StringVar(&skipPolicy, "skip", "hash", loc.print("flagSkip"))
+	flag.BoolVar(&sanitizeNames, "sanitize", false, loc.print("flagSanitize"))
+	flag.StringVar(&collision, "collision", "rename", loc.print("flagCollision"))
+	flag.StringVar(&symlinks, "symlinks", "files", loc.print("flagSymlinks"))
+	var includes, excludes ruleFlags
+	var minSize, maxSize, minAge, maxAge string
+	flag.Var(&includes, "include", loc.print("flagInclude"))
+	flag.Var(&excludes, "exclude", loc.print("flagExclude"))
+	flag.StringVar(&minSize, "min-size", "", loc.print("flagMinSize"))
+	flag.StringVar(&maxSize, "max-size", "", loc.print("flagMaxSize"))
+	flag.StringVar(&minAge, "min-age", "", loc.print("flagMinAge"))
+	flag.StringVar(&maxAge, "max-age", "", loc.print("flagMaxAge"))
+	var deleteAfter bool
+	var moveAfter string
+	flag.BoolVar(&deleteAfter, "delete-after", false, loc.print("flagDeleteAfter"))
+	flag.StringVar(&moveAfter, "move-after", "", loc.print("flagMoveAfter"))
+	var dryRun bool
+	var planFormat, planSpeed string
+	flag.BoolVar(&dryRun, "dry-run", false, loc.print("flagDryRun"))
+	flag.StringVar(&planFormat, "plan-format", "text", loc.print("flagPlanFormat"))
+	flag.StringVar(&planSpeed, "plan-speed", "10M", loc.print("flagPlanSpeed"))
+	var reportPath, retryFailed, output string
+	flag.StringVar(&output, "output", "text", loc.print("flagOutput"))
+	flag.StringVar(&reportPath, "report", "", loc.print("flagReport"))
+	flag.StringVar(&retryFailed, "retry-failed", "", loc.print("flagRetryFailed"))
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), loc.print("usage"), os.Args[0])
+		flag.PrintDefaults()
+	}
 	// 从arguments中解析注册的flag。必须在所有flag都注册好而未访问其值时执行。未注册却使用flag -help时，会返回ErrHelp。
 	flag.Parse()
+	switch skipPolicy {
+	case "name", "size", "hash":
+	default:
+		log.Fatalf(loc.print("invalidSkipPolicy"), skipPolicy)
+	}
+	switch collision {
+	case "rename", "skip", "abort":
+	default:
+		log.Fatalf(loc.print("invalidCollision"), collision)
+	}
+	switch symlinks {
+	case "files", "skip", "follow", "record":
+	default:
+		log.Fatalf(loc.print("invalidSymlinks"), symlinks)
+	}
+	var err error
+	if mode, err = parseConflictPolicy(mode); err != nil {
+		log.Fatalln(err)
+	}
+	for _, rule := range rules {
+		if err := addConflictRule(rule); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	filter, err := fileutil.NewFilter(includes, excludes, minSize, maxSize, minAge, maxAge)
+	if err != nil {
+		log.Fatalf(loc.print("invalidFilter"), err)
+	}
+	if retryFailed != "" {
+		// 只重新上传报告中失败和没有完成的文件，上传的文件夹和目标默认与报告中的相同
+		previous, paths, err := loadRetry(retryFailed)
+		if err != nil {
+			log.Fatalf(loc.print("invalidRetryReport"), retryFailed, err)
+		}
+		if len(paths) == 0 {
+			log.Println(loc.print("nothingToRetry"))
+			return
+		}
+		if folder == "" {
+			folder = previous.Source
+		}
+		if targetFolder == "" {
+			targetFolder = previous.Target
+		}
+		filter.Only(paths)
+	}
+	fileutil.SetFilter(filter)
+	if deleteAfter && moveAfter != "" {
+		log.Fatalln(loc.print("afterUploadConflict"))
+	}
+	if moveAfter != "" {
+		// 上传时会切换工作目录，目标文件夹先转换为绝对路径；
+		// 目标文件夹不能在上传的文件夹里面，否则移走的文件会再次被扫描到
+		if moveAfter, err = filepath.Abs(moveAfter); err != nil {
+			log.Fatalln(err)
+		}
+		if source, err := filepath.Abs(folder); err == nil && folder != "" {
+			if rel, err := filepath.Rel(source, moveAfter); err == nil && (rel == "." || !strings.HasPrefix(rel, "..")) {
+				log.Fatalf(loc.print("invalidMoveAfter"), moveAfter)
+			}
+		}
+	}
+	fileutil.SetAfterUpload(deleteAfter, moveAfter)
+	switch output {
+	case "text":
+	case "json":
+		// -output json 时试运行的计划同样输出为 JSON
+		planFormat = "json"
+	default:
+		log.Fatalf(loc.print("invalidOutput"), output)
+	}
+	switch planFormat {
+	case "text", "json":
+	default:
+		log.Fatalf(loc.print("invalidPlanFormat"), planFormat)
+	}
+	speedPerSecond, err := fileutil.ParseSize(planSpeed)
+	if err != nil || speedPerSecond <= 0 {
+		log.Fatalf(loc.print("invalidPlanSpeed"), planSpeed)
+	}
+	var plan *fileutil.Plan
+	if dryRun {
+		// 试运行只扫描和检查网盘，不上传、不创建文件夹，也不写索引等记录文件
+		plan = &fileutil.Plan{}
+		fileutil.SetPlan(plan)
+	}
 
-	loc = Loc{}
 	if configFile != "" && folder != "" {
 		filePtr, err := os.Open(configFile)
 		if err != nil {
@@ -313,12 +852,45 @@ func main() {
 			httpLocal.ChangeCNURL()
 		}
 
-		if info.Language != "en" && lang == "en" {
-			loc.init(info.Language)
-			lang = info.Language
+		// 每个后端使用一个连接池，空闲连接数与线程数匹配，代理、CA 证书和出口地址以命令行参数优先
+		if proxy != "" {
+			info.Proxy = proxy
+		}
+		if telegramProxy != "" {
+			info.TelegramProxy = telegramProxy
+		}
+		if caBundle != "" {
+			info.CABundle = caBundle
+		}
+		if localAddr != "" {
+			info.LocalAddr = localAddr
+		}
+		netConfig := httpLocal.TransportConfig{Threads: thread, Proxy: info.Proxy, CABundle: info.CABundle, LocalAddr: info.LocalAddr}
+		driveTransport, err := httpLocal.NewTransport(netConfig)
+		if err != nil {
+			log.Panicln(err)
+		}
+		if info.Drive == "GoogleDrive" {
+			googledrive.SetTransport(driveTransport)
 		} else {
-			loc.init(lang)
+			httpLocal.SetTransport(driveTransport)
+		}
+		netConfig.Proxy = info.TelegramProxy
+		telegramTransport, err := httpLocal.NewTransport(netConfig)
+		if err != nil {
+			log.Panicln(err)
 		}
+		telegramClient = &http.Client{Transport: telegramTransport, Timeout: telegramTimeout}
+		i18nClient = &http.Client{Transport: driveTransport}
+
+		// 语言优先级：命令行参数 > 配置文件 > 环境变量
+		if lang == "" {
+			lang = info.Language
+		}
+		if lang == "" {
+			lang = detectLanguage()
+		}
+		loc.init(lang)
 
 		if info.BlockSize != 10 && block == 10 {
 			fileutil.SetDefaultChunkSize(info.BlockSize)
@@ -333,78 +905,167 @@ func main() {
 			fileutil.SetTimeOut(timeOut)
 		}
 
+		if info.MinSpeed != 0 && minSpeed == 32 {
+			fileutil.SetMinSpeed(info.MinSpeed)
+			minSpeed = info.MinSpeed
+		} else {
+			fileutil.SetMinSpeed(minSpeed)
+		}
+
+		// 配置文件中的规则排在命令行规则之后
+		for _, rule := range info.ConflictRules {
+			if err := addConflictRule(rule); err != nil {
+				log.Fatalln(err)
+			}
+		}
+
 		if info.BotKey != "" && info.UserID != "" && botKey == "1" {
 			botKey = info.BotKey
 			_UserID = info.UserID
 		}
-
-		startTime := time.Now().Unix()
-		writer := uilive.New()
-		writer.Start()
-		size, err := DirSize(folder)
-		if err != nil {
-			log.Panic(err)
+		if dryRun {
+			// 试运行不发送 Telegram 通知
+			botKey, _UserID = "", ""
 		}
 
-		_, _ = fmt.Fprintf(writer, loc.print("startToUpload"), folder, fileutil.Byte2Readable(float64(size)))
+		// 第一次收到 Ctrl-C 或 SIGTERM 时停止派发新文件，正在传输的分块传完后保存断点并输出摘要；
+		// 第二次收到信号时立即退出
+		ctx, stop := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			log.Println(loc.print("interruptGraceful"))
+			stop()
+			<-signals
+			log.Println(loc.print("interruptAbort"))
+			os.Exit(130)
+		}()
 
-		updateOutput := func(text string) {
-			if text[:5] != "close" {
-				_, _ = fmt.Fprintf(writer.Newline(), "%s\n", text)
-			} else {
-				_, _ = fmt.Fprintf(writer.Bypass(), "%s\n", text[6:])
+		startTime := time.Now().Unix()
+		writer := uilive.New()
+		account := strings.TrimSuffix(filepath.Base(configFile), ".json")
+		// 扫描和上传同时进行，总大小在扫描结束后才知道
+		stats := fileutil.NewScanStats()
+		if output == "json" && !dryRun {
+			// 标准输出只有每行一个的 JSON 事件，进度文本不再输出
+			writer.Out = ioutil.Discard
+			notify.AddSink(notify.NewJSONSink(os.Stdout, account))
+		} else {
+			if dryRun {
+				// 计划输出到标准输出，进度输出到标准错误，方便保存或交给其他程序处理
+				writer.Out = os.Stderr
 			}
+			// 汇总的进度在终端中刷新显示，输出不是终端时定期输出一行
+			notify.AddSink(newTerminalSink(writer, stats, folder, account, info.Drive))
 		}
-
-		var sendMsg func(string)
+		writer.Start()
+		_, _ = fmt.Fprintln(writer.Bypass(), fmt.Sprintf(loc.print("startToScan"), folder))
 		if botKey != "" && _UserID != "" {
-			sendMsg = botSend(botKey, _UserID, fmt.Sprintf(loc.print("startToUpload"), folder, fileutil.Byte2Readable(float64(size))))
+			notify.AddSink(newTelegramSink(botKey, _UserID, folder, account, info.Drive))
 		}
+		go func() {
+			<-stats.Done()
+			notify.Publish(notify.ScanFinished{Path: folder, Files: stats.Files, Size: stats.Size})
+		}()
 		switch info.Drive {
 		case "OneDrive":
-			Upload(strings.ReplaceAll(configFile, "\\", "/"), strings.ReplaceAll(folder, "\\", "/"), targetFolder, thread, func() (func(text string), string, string) {
-				if botKey != "" && _UserID != "" {
-					return updateOutput, botKey, _UserID
-				} else {
-					return updateOutput, "", ""
-				}
-			}, func(text string) string {
+			Upload(ctx, strings.ReplaceAll(configFile, "\\", "/"), strings.ReplaceAll(folder, "\\", "/"), targetFolder, thread, stats, func(text string) string {
 				return loc.print(text)
 			})
 		case "GoogleDrive":
-			googledrive.Upload(strings.ReplaceAll(configFile, "\\", "/"), strings.ReplaceAll(folder, "\\", "/"), func() (func(text string), string, string, func(string, string, string) func(string)) {
-				if botKey != "" && _UserID != "" {
-					return updateOutput, botKey, _UserID, botSend
-				} else {
-					return updateOutput, "", "", nil
+			infoPath, err := filepath.Abs(configFile)
+			if err != nil {
+				log.Panic(err)
+			}
+			index, err := loadIndex(infoPath)
+			if err != nil {
+				log.Panic(err)
+			}
+			links := setSymlinks(infoPath, func(p string) string {
+				remote, err := filepath.Rel(filepath.Dir(folder), p)
+				if err != nil {
+					return filepath.ToSlash(p)
 				}
-			}, func(text string) string {
+				return filepath.ToSlash(remote)
+			})
+			defer links.Close()
+			googledrive.Upload(ctx, strings.ReplaceAll(configFile, "\\", "/"), strings.ReplaceAll(folder, "\\", "/"), index, rescanRemote, stats, func(text string) string {
 				return loc.print(text)
 			}, thread, block, lang, timeOut, botKey, _UserID)
+			if err := index.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if dryRun {
+			writer.Stop()
+			if err := printPlan(os.Stdout, plan, planFormat, speedPerSecond); err != nil {
+				log.Fatalln(err)
+			}
+			if ctx.Err() != nil {
+				os.Exit(130)
+			}
+			return
+		}
 
+		if deleteAfter {
+			_, _ = fmt.Fprintln(writer.Bypass(), fmt.Sprintf(loc.print("sourcesDeleted"), fileutil.FinishedSources()))
+		} else if moveAfter != "" {
+			_, _ = fmt.Fprintln(writer.Bypass(), fmt.Sprintf(loc.print("sourcesMoved"), fileutil.FinishedSources(), moveAfter))
 		}
 
-		cost := time.Now().Unix() - startTime
-		speed := fileutil.Byte2Readable(float64(size) / float64(cost))
-		_, _ = fmt.Fprintf(writer.Bypass(), loc.print("completeUpload"), folder, cost, speed)
-		if botKey != "" && _UserID != "" {
-			log.Printf(fmt.Sprintf(loc.print("completeUpload"), folder, cost, speed))
-			sendMsg(fmt.Sprintf(loc.print("completeUpload"), folder, cost, speed))
+		report := newRunReport(folder, targetFolder, info.Drive, time.Unix(startTime, 0))
+		if reportPath != "" {
+			if err := report.write(reportPath); err != nil {
+				log.Printf(loc.print("reportFail"), err)
+			}
+		}
+		notify.Publish(report.finished(stats.Size, ctx.Err() != nil))
+		writer.Stop()
+		if ctx.Err() != nil {
+			os.Exit(130)
+		}
+		if code := report.exitCode(); code != 0 {
+			os.Exit(code)
 		}
 	} else {
+		if proxy != "" || caBundle != "" || localAddr != "" {
+			t, err := httpLocal.NewTransport(httpLocal.TransportConfig{Proxy: proxy, CABundle: caBundle, LocalAddr: localAddr})
+			if err != nil {
+				log.Panicln(err)
+			}
+			httpLocal.SetTransport(t)
+			googledrive.SetTransport(t)
+			i18nClient = &http.Client{Transport: t}
+		}
+		if lang == "" {
+			lang = detectLanguage()
+		}
 		loc.init(lang)
+		if updateLang {
+			// 只有明确要求时才联网更新语言文件
+			target, err := updateCatalog(lang)
+			if err != nil {
+				log.Panicln(err)
+			}
+			log.Printf(loc.print("langUpdated"), lang, target)
+			return
+		}
 		if codeURL == "" {
 			if ms != 3 {
-				flag.PrintDefaults()
+				flag.Usage()
 			} else {
 				log.Printf(loc.print("googleDriveGetAccess"), googledrive.GetURL())
 				inputReader := bufio.NewReader(os.Stdin)
 				code, err := inputReader.ReadString('\n')
 				if err != nil {
-					fmt.Println("There ware errors reading,exiting program.")
+					fmt.Println(loc.print("readCodeError"))
 					return
 				}
-				mail := googledrive.CreateNewInfo(code, lang)
+				mail := googledrive.CreateNewInfo(code, lang, func(text string) string {
+					return loc.print(text)
+				})
 				log.Println(loc.print("googleDriveOAuthFileCreateSuccess") + mail)
 			}
 
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// jsonLine is one line of -output json. Path, size, bytes, speed, account and
+// error are always present; the other fields only on the events they belong to:
+// scan, start, progress, retry, checkpoint, done, failed, kept and summary.
+type jsonLine struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Bytes   int64     `json:"bytes"`
+	Speed   int64     `json:"speed"`
+	Account string    `json:"account"`
+	Error   string    `json:"error"`
+
+	RemotePath string `json:"remotePath,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Message    string `json:"message,omitempty"`
+	ItemID     string `json:"itemId,omitempty"`
+	Attempt    int    `json:"attempt,omitempty"`
+	Files      int64  `json:"files,omitempty"`
+	Uploaded   int    `json:"uploaded,omitempty"`
+	Skipped    int    `json:"skipped,omitempty"`
+	Failed     int    `json:"failed,omitempty"`
+	Unfinished int    `json:"unfinished,omitempty"`
+	Duration   int64  `json:"duration,omitempty"`
+}
+
+// JSONSink writes the events as newline delimited JSON
+type JSONSink struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	account string
+}
+
+// NewJSONSink returns a sink writing the events of the upload of account to w
+func NewJSONSink(w io.Writer, account string) *JSONSink {
+	return &JSONSink{encoder: json.NewEncoder(w), account: account}
+}
+
+// Handle writes event as one line
+func (s *JSONSink) Handle(event Event) {
+	var line jsonLine
+	switch e := event.(type) {
+	case ScanFinished:
+		line = jsonLine{Event: "scan", Path: e.Path, Size: e.Size, Files: e.Files}
+	case FileStarted:
+		line = jsonLine{Event: "start", Path: e.Path, RemotePath: e.RemotePath, Size: e.Size}
+	case ChunkUploaded:
+		line = jsonLine{Event: "progress", Path: e.Path, Size: e.Size, Bytes: e.Bytes, Speed: e.Speed}
+	case Retrying:
+		line = jsonLine{Event: "retry", Path: e.Path, Reason: e.Reason, Attempt: e.Attempt}
+		if e.Err != nil {
+			line.Message = e.Err.Error()
+		}
+	case Checkpoint:
+		line = jsonLine{Event: "checkpoint", Path: e.Path, Size: e.Size, Bytes: e.Bytes}
+	case FileDone:
+		line = jsonLine{Event: "done", Path: e.Path, RemotePath: e.RemotePath, Size: e.Size, Status: e.Status, Reason: e.Reason, ItemID: e.ItemID}
+		if e.Status == "uploaded" {
+			line.Bytes = e.Size
+			if e.Elapsed > 0 {
+				line.Speed = int64(float64(e.Size) / e.Elapsed.Seconds())
+			}
+		}
+	case FileFailed:
+		line = jsonLine{Event: "failed", Path: e.Path, RemotePath: e.RemotePath, Size: e.Size, Status: e.Status, Reason: e.Reason, Error: e.Reason, Message: e.Err}
+	case SourceKept:
+		line = jsonLine{Event: "kept", Path: e.Path, Error: "kept", Message: e.Err.Error()}
+	case RunFinished:
+		line = jsonLine{Event: "summary", Path: e.Source, RemotePath: e.Target, Size: e.Size, Bytes: e.Bytes, Uploaded: e.Uploaded, Skipped: e.Skipped, Failed: e.Failed, Unfinished: e.Unfinished, Duration: int64(e.Duration.Seconds())}
+		if e.Duration >= time.Second {
+			line.Speed = int64(float64(e.Bytes) / e.Duration.Seconds())
+		}
+		if e.Interrupted {
+			line.Error = "interrupted"
+		}
+	default:
+		return
+	}
+	line.Time = time.Now()
+	line.Account = s.account
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_ = s.encoder.Encode(line)
+}
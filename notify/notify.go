@@ -0,0 +1,132 @@
+// Package notify carries the progress of an upload as typed events to the
+// sinks that show it, e.g. the terminal, Telegram or JSON lines. Every sink
+// renders the events in its own format.
+package notify
+
+import "time"
+
+// Event is one step of the upload
+type Event interface {
+	event()
+}
+
+// ScanFinished is published when the scan of the source folder is complete
+type ScanFinished struct {
+	Path  string
+	Files int64
+	Size  int64
+}
+
+// FileStarted is published when the upload of a file starts
+type FileStarted struct {
+	Path       string
+	RemotePath string
+	Size       int64
+}
+
+// ChunkUploaded is published after a part of a file was uploaded, Bytes of
+// Size are done. Resumed of them were uploaded by an earlier run whose
+// upload was continued. Speed is in bytes per second.
+type ChunkUploaded struct {
+	Path    string
+	Size    int64
+	Bytes   int64
+	Resumed int64
+	Chunk   int
+	Chunks  int
+	Speed   int64
+	Elapsed time.Duration
+}
+
+// Retrying is published when a file is uploaded again: Reason is network for
+// a failed request, with Err, or changed when the file changed during its upload
+type Retrying struct {
+	Path    string
+	Reason  string
+	Attempt int
+	Err     error
+}
+
+// Checkpoint is published when an interrupted upload was saved after Bytes
+// of Size, it is resumed on the next run
+type Checkpoint struct {
+	Path  string
+	Bytes int64
+	Size  int64
+}
+
+// FileDone is published when a file was uploaded or skipped, Reason tells why
+// it was skipped
+type FileDone struct {
+	Path       string
+	RemotePath string
+	Size       int64
+	Status     string
+	Reason     string
+	ItemID     string
+	Elapsed    time.Duration
+}
+
+// FileFailed is published when a file failed or was left unfinished by an
+// interrupt. Reason is a stable error code, Err the message of the error.
+type FileFailed struct {
+	Path       string
+	RemotePath string
+	Size       int64
+	Status     string
+	Reason     string
+	Err        string
+}
+
+// SourceKept is published when -delete-after or -move-after left the local
+// file in place after its upload
+type SourceKept struct {
+	Path string
+	Err  error
+}
+
+// RunFinished is published at the end of the run. Size is what the scan
+// found, Bytes what was uploaded.
+type RunFinished struct {
+	Source      string
+	Target      string
+	Size        int64
+	Bytes       int64
+	Uploaded    int
+	Skipped     int
+	Failed      int
+	Unfinished  int
+	Duration    time.Duration
+	Interrupted bool
+	Failures    []FileFailed
+}
+
+func (ScanFinished) event()  {}
+func (FileStarted) event()   {}
+func (ChunkUploaded) event() {}
+func (Retrying) event()      {}
+func (Checkpoint) event()    {}
+func (FileDone) event()      {}
+func (FileFailed) event()    {}
+func (SourceKept) event()    {}
+func (RunFinished) event()   {}
+
+// Sink shows the events, Handle is called from the upload threads and should
+// not wait on the network
+type Sink interface {
+	Handle(event Event)
+}
+
+var sinks []Sink
+
+// AddSink makes the events published from now on go to sink as well
+func AddSink(sink Sink) {
+	sinks = append(sinks, sink)
+}
+
+// Publish hands event to every sink
+func Publish(event Event) {
+	for _, sink := range sinks {
+		sink.Handle(event)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"main/fileutil"
+	"time"
+)
+
+// planActions 是计划中动作的输出顺序
+var planActions = []string{"upload", "replace", "rename", "skip"}
+
+// plannedAction returns what the upload would do with a file and why it is
+// skipped, from the same decisions the upload makes
+func plannedAction(indexed bool, skipReason string, conflictOption string, exists bool) (string, string) {
+	switch {
+	case indexed:
+		return "skip", "index"
+	case skipReason != "":
+		return "skip", skipReason
+	case !exists:
+		return "upload", ""
+	case conflictOption == "fail":
+		return "skip", "conflict"
+	case conflictOption == "rename":
+		return "rename", ""
+	default:
+		return "replace", ""
+	}
+}
+
+// planTotal is the number and size of the files with one planned action
+type planTotal struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// planReport is the dry run result written by -plan-format json
+type planReport struct {
+	Files            []fileutil.PlannedFile `json:"files"`
+	Folders          []string               `json:"folders"`
+	Totals           map[string]planTotal   `json:"totals"`
+	TransferSize     int64                  `json:"transferSize"`
+	Speed            int64                  `json:"speed"`
+	EstimatedSeconds int64                  `json:"estimatedSeconds"`
+}
+
+// newPlanReport sums up plan, the estimated duration assumes speed bytes per second
+func newPlanReport(plan *fileutil.Plan, speed int64) planReport {
+	report := planReport{Files: plan.Files(), Folders: plan.Folders(), Totals: make(map[string]planTotal), Speed: speed}
+	if report.Folders == nil {
+		report.Folders = []string{}
+	}
+	for _, file := range report.Files {
+		total := report.Totals[file.Action]
+		total.Files++
+		total.Size += file.Size
+		report.Totals[file.Action] = total
+		if file.Action != "skip" {
+			report.TransferSize += file.Size
+		}
+	}
+	if speed > 0 {
+		report.EstimatedSeconds = (report.TransferSize + speed - 1) / speed
+	}
+	return report
+}
+
+// printPlan writes the dry run result to w as text or json
+func printPlan(w io.Writer, plan *fileutil.Plan, format string, speed int64) error {
+	report := newPlanReport(plan, speed)
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	for _, file := range report.Files {
+		line := fmt.Sprintf("%-8s %10s  %s", file.Action, fileutil.Byte2Readable(float64(file.Size)), file.RemotePath)
+		if file.Reason != "" {
+			line += " (" + file.Reason + ")"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	for _, folder := range report.Folders {
+		_, _ = fmt.Fprintf(w, loc.print("planFolder")+"\n", folder)
+	}
+	_, _ = fmt.Fprintln(w)
+	for _, action := range planActions {
+		total := report.Totals[action]
+		_, _ = fmt.Fprintf(w, loc.print("planTotal")+"\n", action, total.Files, fileutil.Byte2Readable(float64(total.Size)))
+	}
+	_, _ = fmt.Fprintf(w, loc.print("planFolders")+"\n", len(report.Folders))
+	_, err := fmt.Fprintf(w, loc.print("planEstimate")+"\n", fileutil.Byte2Readable(float64(report.TransferSize)), time.Duration(report.EstimatedSeconds)*time.Second, fileutil.Byte2Readable(float64(speed)))
+	return err
+}
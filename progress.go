@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"main/fileutil"
+	"main/notify"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gosuri/uilive"
+)
+
+// 终端中进度每秒刷新一次，不是终端时每 plainInterval 输出一行进度
+const (
+	progressInterval = time.Second
+	plainInterval    = 10 * time.Second
+	// speedSmoothing 是平滑速度时新采样的权重
+	speedSmoothing = 0.3
+)
+
+// fileProgress is the progress of a file being uploaded
+type fileProgress struct {
+	path  string
+	size  int64
+	bytes int64
+	speed int64
+}
+
+// terminalSink shows the events in the terminal. Above the lines writer
+// refreshes it prints what happened to every file, the refreshed lines are
+// the progress of the whole run followed by one line per file being
+// uploaded. When the output is not a terminal the progress of the run is
+// printed as a plain line every plainInterval instead.
+type terminalSink struct {
+	writer  *uilive.Writer
+	stats   *fileutil.ScanStats
+	folder  string
+	account string
+	drive   string
+	tty     bool
+
+	mutex   sync.Mutex
+	files   []*fileProgress
+	done    int64
+	size    int64
+	sent    int64
+	speed   float64
+	sampled int64
+	stopped bool
+	stop    chan struct{}
+}
+
+// newTerminalSink starts showing the progress of the upload of folder, stats
+// are the files found by the scan so far
+func newTerminalSink(writer *uilive.Writer, stats *fileutil.ScanStats, folder string, account string, drive string) *terminalSink {
+	s := &terminalSink{writer: writer, stats: stats, folder: folder, account: account, drive: drive, tty: isTerminal(writer.Out), stop: make(chan struct{})}
+	go s.refresh()
+	return s
+}
+
+// isTerminal reports whether w writes to a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// refresh samples the speed and shows the progress until the run is finished
+func (s *terminalSink) refresh() {
+	interval := progressInterval
+	if !s.tty {
+		interval = plainInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		s.mutex.Lock()
+		// 速度按每次采样之间实际发送的字节数平滑计算，不受单个分块用时的影响
+		instant := float64(s.sent-s.sampled) / interval.Seconds()
+		if s.sampled == 0 && s.speed == 0 {
+			s.speed = instant
+		} else {
+			s.speed = speedSmoothing*instant + (1-speedSmoothing)*s.speed
+		}
+		s.sampled = s.sent
+		if s.tty {
+			s.render()
+		} else if !fileutil.DryRun() {
+			_, _ = fmt.Fprintln(s.writer.Bypass(), s.total())
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// total returns the progress line of the whole run, the mutex is held
+func (s *terminalSink) total() string {
+	files, size := atomic.LoadInt64(&s.stats.Files), atomic.LoadInt64(&s.stats.Size)
+	current := s.size
+	for _, file := range s.files {
+		current += file.bytes
+	}
+	eta := "--"
+	select {
+	case <-s.stats.Done():
+		// 扫描结束前总大小还在增加，不估计剩余时间
+		if s.speed >= 1 && size >= current {
+			eta = (time.Duration(float64(size-current)/s.speed) * time.Second).String()
+		}
+	default:
+	}
+	return fmt.Sprintf(loc.print("progressTotal"), s.done, files, fileutil.Byte2Readable(float64(current)), fileutil.Byte2Readable(float64(size)), fileutil.Byte2Readable(s.speed), eta)
+}
+
+// render writes the refreshed lines, the mutex is held
+func (s *terminalSink) render() {
+	if s.stopped || fileutil.DryRun() {
+		return
+	}
+	lines := []string{s.total()}
+	for _, file := range s.files {
+		percent := 100
+		if file.size > 0 {
+			percent = int(file.bytes * 100 / file.size)
+		}
+		lines = append(lines, fmt.Sprintf(loc.print("progressFile"), file.path, percent, fileutil.Byte2Readable(float64(file.bytes)), fileutil.Byte2Readable(float64(file.size)), fileutil.Byte2Readable(float64(file.speed))))
+	}
+	_, _ = fmt.Fprintln(s.writer, strings.Join(lines, "\n"))
+	// 立即输出，两次刷新之间的多次更新不会叠在一起
+	_ = s.writer.Flush()
+}
+
+// file returns the progress of the file at p being uploaded, the mutex is held
+func (s *terminalSink) file(p string) (int, *fileProgress) {
+	for i, file := range s.files {
+		if file.path == p {
+			return i, file
+		}
+	}
+	return -1, nil
+}
+
+// finish counts the file at p of size bytes as done, the mutex is held
+func (s *terminalSink) finish(p string, size int64, uploaded bool) {
+	s.done++
+	s.size += size
+	if i, file := s.file(p); file != nil {
+		s.files = append(s.files[:i], s.files[i+1:]...)
+		if uploaded && size > file.bytes {
+			s.sent += size - file.bytes
+		}
+	} else if uploaded {
+		s.sent += size
+	}
+}
+
+func (s *terminalSink) Handle(event notify.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch e := event.(type) {
+	case notify.FileStarted:
+		// 重新排队的文件从头开始显示
+		if _, file := s.file(e.Path); file != nil {
+			file.size, file.bytes, file.speed = e.Size, 0, 0
+		} else {
+			s.files = append(s.files, &fileProgress{path: e.Path, size: e.Size})
+		}
+		return
+	case notify.ChunkUploaded:
+		_, file := s.file(e.Path)
+		if file == nil {
+			return
+		}
+		// 继续上次中断的上传时，之前上传的部分不是本次发送的
+		previous := file.bytes
+		if previous < e.Resumed {
+			previous = e.Resumed
+		}
+		if e.Bytes >= previous {
+			s.sent += e.Bytes - previous
+		} else {
+			s.sent += e.Bytes
+		}
+		file.size, file.bytes, file.speed = e.Size, e.Bytes, e.Speed
+		return
+	case notify.FileDone:
+		s.finish(e.Path, e.Size, e.Status == "uploaded")
+	case notify.FileFailed:
+		s.finish(e.Path, e.Size, false)
+	case notify.RunFinished:
+		// 摘要之后不再刷新进度
+		if !s.stopped {
+			s.stopped = true
+			close(s.stop)
+		}
+	}
+	if text := eventText(event, s.folder, s.account, s.drive); text != "" {
+		_, _ = fmt.Fprintln(s.writer.Bypass(), text)
+	}
+	if s.tty {
+		s.render()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"main/fileutil"
+	"main/notify"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 部分文件失败和全部失败时的退出码，中断时为 130
+const (
+	exitPartial = 2
+	exitFailed  = 3
+)
+
+// runReport is the result of one run, written by -report and read back by -retry-failed
+type runReport struct {
+	Source     string                `json:"source"`
+	Target     string                `json:"target"`
+	Drive      string                `json:"drive"`
+	Started    time.Time             `json:"started"`
+	Duration   int64                 `json:"duration"`
+	Uploaded   int                   `json:"uploaded"`
+	Skipped    int                   `json:"skipped"`
+	Failed     int                   `json:"failed"`
+	Unfinished int                   `json:"unfinished"`
+	Bytes      int64                 `json:"bytes"`
+	Files      []fileutil.FileResult `json:"files"`
+}
+
+// newRunReport sums up the results of the run that started at started
+func newRunReport(source string, target string, drive string, started time.Time) runReport {
+	if abs, err := filepath.Abs(source); err == nil {
+		source = abs
+	}
+	report := runReport{Source: source, Target: target, Drive: drive, Started: started, Duration: int64(time.Since(started).Seconds()), Files: fileutil.RunResults()}
+	if report.Files == nil {
+		report.Files = []fileutil.FileResult{}
+	}
+	for _, file := range report.Files {
+		switch file.Status {
+		case "uploaded":
+			report.Uploaded++
+			report.Bytes += file.Size
+		case "skipped":
+			report.Skipped++
+		case "failed":
+			report.Failed++
+		case "unfinished":
+			report.Unfinished++
+		}
+	}
+	return report
+}
+
+// finished returns the report as the RunFinished event, size is what the scan found
+func (r runReport) finished(size int64, interrupted bool) notify.RunFinished {
+	event := notify.RunFinished{Source: r.Source, Target: r.Target, Size: size, Bytes: r.Bytes, Uploaded: r.Uploaded, Skipped: r.Skipped, Failed: r.Failed, Unfinished: r.Unfinished, Duration: time.Since(r.Started), Interrupted: interrupted}
+	for _, file := range r.Files {
+		if file.Status == "failed" {
+			event.Failures = append(event.Failures, file.Failure())
+		}
+	}
+	return event
+}
+
+// exitCode is 0 when no file failed, exitFailed when nothing was uploaded or
+// skipped at all and exitPartial otherwise
+func (r runReport) exitCode() int {
+	if r.Failed == 0 {
+		return 0
+	}
+	if r.Uploaded == 0 && r.Skipped == 0 {
+		return exitFailed
+	}
+	return exitPartial
+}
+
+// write saves the report to path, as CSV when path ends with .csv and as JSON otherwise
+func (r runReport) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w := csv.NewWriter(f)
+		_ = w.Write([]string{"path", "remotePath", "status", "reason", "size", "itemId", "webUrl", "error"})
+		for _, file := range r.Files {
+			_ = w.Write([]string{file.Path, file.RemotePath, file.Status, file.Reason, strconv.FormatInt(file.Size, 10), file.ItemID, file.WebURL, file.Error})
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(r)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// loadRetry reads the JSON report at path and returns the files of it that
+// failed or were not finished
+func loadRetry(path string) (runReport, []string, error) {
+	var report runReport
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return report, nil, err
+	}
+	if err = json.Unmarshal(data, &report); err != nil {
+		return report, nil, err
+	}
+	var paths []string
+	for _, file := range report.Files {
+		if file.Status == "failed" || file.Status == "unfinished" {
+			paths = append(paths, file.Path)
+		}
+	}
+	return report, paths, nil
+}
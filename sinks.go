@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"main/fileutil"
+	"main/notify"
+	"strings"
+	"sync"
+	"time"
+)
+
+// skipTexts 是跳过原因对应的提示
+var skipTexts = map[string]string{
+	"index":    "indexSkip",
+	"exists":   "existSkip",
+	"newer":    "conflictNewerSkip",
+	"larger":   "conflictLargerSkip",
+	"vanished": "sourceVanished",
+	"conflict": "conflictExists",
+	"etag":     "conflictChanged",
+}
+
+// driveNames 是提示中显示的网盘名称
+var driveNames = map[string]string{
+	"OneDrive":    "OneDrive",
+	"GoogleDrive": "Google Drive",
+}
+
+// eventText returns the text of event shown in the terminal and sent to
+// Telegram, folder is the uploaded folder. Events without a text return "".
+func eventText(event notify.Event, folder string, account string, drive string) string {
+	switch e := event.(type) {
+	case notify.ScanFinished:
+		text := fmt.Sprintf(loc.print("scanComplete"), folder, e.Files, fileutil.Byte2Readable(float64(e.Size)))
+		for _, count := range fileutil.FilterReport() {
+			text += "\n" + fmt.Sprintf(loc.print("filterExcluded"), count.Rule, count.Files, count.Dirs)
+		}
+		return text
+	case notify.FileStarted:
+		return fmt.Sprintf(loc.print("startToUpload"), e.Path, driveNames[drive])
+	case notify.ChunkUploaded:
+		return fmt.Sprintf(loc.print("uploadProgress"), driveNames[drive], account, e.Path, fileutil.Byte2Readable(float64(e.Size)), fileutil.Byte2Readable(float64(e.Bytes)), e.Chunk, e.Chunks, fileutil.Byte2Readable(float64(e.Speed)), int64(e.Elapsed.Seconds()))
+	case notify.Retrying:
+		if e.Reason == "changed" {
+			return "`" + e.Path + "` " + loc.print("sourceChanged")
+		}
+		return fmt.Sprintf(loc.print("failToLink"), account, e.Path, e.Attempt)
+	case notify.Checkpoint:
+		return fmt.Sprintf(loc.print("uploadCheckpoint"), e.Path, fileutil.Byte2Readable(float64(e.Bytes)), fileutil.Byte2Readable(float64(e.Size)))
+	case notify.FileDone:
+		if e.Status == "uploaded" {
+			var speed float64
+			if e.Elapsed > 0 {
+				speed = float64(e.Size) / e.Elapsed.Seconds()
+			}
+			return fmt.Sprintf(loc.print("completeUpload"), e.Path, int64(e.Elapsed.Seconds()), fileutil.Byte2Readable(speed))
+		}
+		return "`" + e.Path + "` " + loc.print(skipTexts[e.Reason])
+	case notify.FileFailed:
+		// 中断时没有完成的文件在摘要中统计
+		switch e.Reason {
+		case "unstable":
+			return "`" + e.Path + "` " + loc.print("sourceUnstable")
+		case "upload":
+			return "`" + e.Path + "` " + fmt.Sprintf(loc.print("uploadFailed"), e.Err)
+		case "read":
+			return "`" + e.Path + "` " + fmt.Sprintf(loc.print("readFailed"), e.Err)
+		case "list":
+			return "`" + e.Path + "` " + fmt.Sprintf(loc.print("listFailed"), e.Err)
+		}
+	case notify.SourceKept:
+		switch e.Err {
+		case fileutil.ErrNotVerified:
+			return "`" + e.Path + "` " + loc.print("sourceNotVerified")
+		case fileutil.ErrNotOnDrive:
+			return "`" + e.Path + "` " + loc.print("sourceNotOnDrive")
+		}
+		return "`" + e.Path + "` " + fmt.Sprintf(loc.print("sourceFinishFail"), e.Err)
+	case notify.RunFinished:
+		return runText(e, folder)
+	}
+	return ""
+}
+
+// runText returns the summary of the run, the counts followed by every failed file
+func runText(e notify.RunFinished, folder string) string {
+	if e.Interrupted {
+		return fmt.Sprintf(loc.print("uploadInterrupted"), loc.printN("filesCompleted", e.Uploaded+e.Skipped), loc.printN("filesUnfinished", e.Failed+e.Unfinished))
+	}
+	cost := int64(e.Duration.Seconds())
+	lines := []string{fmt.Sprintf(loc.print("runSummary"), loc.printN("filesUploaded", e.Uploaded), fileutil.Byte2Readable(float64(e.Bytes)), loc.printN("filesSkipped", e.Skipped), loc.printN("filesFailed", e.Failed), loc.printN("filesUnfinished", e.Unfinished), cost)}
+	// 有文件失败时不再显示上传完成
+	if e.Failed == 0 {
+		var speed float64
+		if e.Duration > 0 {
+			speed = float64(e.Size) / e.Duration.Seconds()
+		}
+		lines = append([]string{fmt.Sprintf(loc.print("completeUpload"), folder, cost, fileutil.Byte2Readable(speed))}, lines...)
+	}
+	for _, file := range e.Failures {
+		reason := file.Reason
+		if file.Err != "" {
+			reason = file.Err
+		}
+		lines = append(lines, fmt.Sprintf(loc.print("runFailedFile"), file.Path, reason))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// telegramQueue 是等待发送到 Telegram 的消息数量上限，队列满时丢弃新的消息
+const telegramQueue = 256
+
+// telegramSink sends the events to a Telegram chat. The scan and the summary
+// update one message for the run, every file being uploaded has its own
+// message that is deleted when the file is done. The messages are sent by one
+// goroutine so a slow Telegram never holds up the upload threads: progress
+// edits of a file replace each other until they are sent, other messages wait
+// in a bounded queue and are dropped when it is full.
+type telegramSink struct {
+	botKey  string
+	userID  string
+	folder  string
+	account string
+	drive   string
+
+	queue    chan telegramUpdate
+	wake     chan struct{}
+	done     chan struct{}
+	mutex    sync.Mutex
+	progress map[string]string
+
+	// 只在发送的 goroutine 中使用
+	run   *telegramMessage
+	files map[string]*telegramMessage
+}
+
+// telegramUpdate is an event waiting to be sent with its text
+type telegramUpdate struct {
+	event notify.Event
+	text  string
+}
+
+// newTelegramSink starts sending the upload of folder to the chat of userID
+func newTelegramSink(botKey string, userID string, folder string, account string, drive string) *telegramSink {
+	s := &telegramSink{
+		botKey:   botKey,
+		userID:   userID,
+		folder:   folder,
+		account:  account,
+		drive:    drive,
+		queue:    make(chan telegramUpdate, telegramQueue),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		progress: make(map[string]string),
+		files:    make(map[string]*telegramMessage),
+	}
+	go s.send()
+	return s
+}
+
+func (s *telegramSink) Handle(event notify.Event) {
+	text := eventText(event, s.folder, s.account, s.drive)
+	switch e := event.(type) {
+	case notify.ChunkUploaded:
+		s.setProgress(e.Path, text)
+	case notify.Retrying:
+		s.setProgress(e.Path, text)
+	case notify.Checkpoint:
+		s.setProgress(e.Path, text)
+	case notify.RunFinished:
+		// 摘要最后发送，最多等待两个请求的超时时间
+		timeout := time.NewTimer(2 * telegramTimeout)
+		defer timeout.Stop()
+		select {
+		case s.queue <- telegramUpdate{event: event, text: text}:
+		case <-timeout.C:
+			return
+		}
+		select {
+		case <-s.done:
+		case <-timeout.C:
+		}
+	default:
+		select {
+		case s.queue <- telegramUpdate{event: event, text: text}:
+		default:
+		}
+	}
+}
+
+// setProgress keeps text as the next edit of the message of the file at p
+func (s *telegramSink) setProgress(p string, text string) {
+	s.mutex.Lock()
+	s.progress[p] = text
+	s.mutex.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send sends the queued messages and the latest progress of every file
+// until the summary is sent
+func (s *telegramSink) send() {
+	defer close(s.done)
+	s.run = sendTelegram(s.botKey, s.userID, fmt.Sprintf(loc.print("startToScan"), s.folder))
+	for {
+		select {
+		case update := <-s.queue:
+			s.apply(update)
+			if _, ok := update.event.(notify.RunFinished); ok {
+				return
+			}
+		case <-s.wake:
+			s.mutex.Lock()
+			progress := s.progress
+			s.progress = make(map[string]string)
+			s.mutex.Unlock()
+			for p, text := range progress {
+				if message, ok := s.files[p]; ok {
+					message.edit(text)
+				}
+			}
+		}
+	}
+}
+
+// apply sends the message of update
+func (s *telegramSink) apply(update telegramUpdate) {
+	switch e := update.event.(type) {
+	case notify.ScanFinished, notify.RunFinished:
+		s.run.edit(update.text)
+	case notify.FileStarted:
+		// 重新排队的文件继续使用上一次的消息
+		if message, ok := s.files[e.Path]; ok {
+			message.edit(update.text)
+			return
+		}
+		s.files[e.Path] = sendTelegram(s.botKey, s.userID, update.text)
+	case notify.FileDone:
+		s.deleteFile(e.Path)
+	case notify.FileFailed:
+		s.deleteFile(e.Path)
+	case notify.SourceKept:
+		// 文件的消息已经删除，保留本地文件的提示单独发送
+		sendTelegram(s.botKey, s.userID, update.text)
+	}
+}
+
+// deleteFile removes the message of the file at p
+func (s *telegramSink) deleteFile(p string) {
+	if message, ok := s.files[p]; ok {
+		delete(s.files, p)
+		message.delete()
+	}
+}